@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How often accounts due deletion are looked for
+const deletionReapInterval = time.Hour
+
+// AccountExport is everything held about a user, given to them when they ask for their data
+type AccountExport struct {
+	Exported time.Time `json:"exported"`
+	// Account is their user document, with secrets such as their password hash taken out.
+	Account      *User             `json:"account"`
+	Sessions     []ExportedSession `json:"sessions"`
+	LoginHistory []AuditEvent      `json:"login_history"`
+	// Invites are the ones they made, if they are an admin
+	Invites []Invite `json:"invites"`
+}
+
+// ExportedSession is one of their sessions, without the key that would let someone use it
+type ExportedSession struct {
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used"`
+	IP        string    `json:"ip"`
+	Country   string    `json:"country"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// Builds the export of a user's data
+func exportAccount(ctx context.Context, user *User) (*AccountExport, error) {
+	account := *user
+	account.Password = nil
+	account.VerifyNonce = ""
+	account.ResetHash = ""
+	account.EmailNonce = ""
+	account.TOTPSecret = ""
+	account.TOTPPending = ""
+	account.RecoveryCodes = nil
+
+	sessions, err := Sessions.UserSessions(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]ExportedSession, 0, len(sessions))
+	for _, session := range sessions {
+		exported = append(exported, ExportedSession{
+			Created:   session.Created,
+			LastUsed:  session.LastActivity,
+			IP:        session.IP,
+			Country:   GetCountry(session.IP),
+			UserAgent: session.UserAgent,
+		})
+	}
+
+	history, err := GetAuditEventsDB(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	invites, err := GetUserInvitesDB(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountExport{
+		Exported:     time.Now(),
+		Account:      &account,
+		Sessions:     exported,
+		LoginHistory: history,
+		Invites:      invites,
+	}, nil
+}
+
+func exportHandle(w http.ResponseWriter, req *http.Request) {
+	user, _ := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	export, dataErr := exportAccount(ctx, user)
+	if dataErr != nil {
+		serveDataError(w, req, user.Locale, dataErr)
+		return
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		log.Println("[!!] Failed to export account:", err)
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.export-failed")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	Audit(AuditExport, user.ID, user.Username, GetClientIP(req), "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"smark-"+user.Username+".json\"")
+	w.Write(data)
+}
+
+func deleteAccountHandle(w http.ResponseWriter, req *http.Request) {
+	user, _ := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	if !passMatch(user.Password, []byte(req.FormValue("password"))) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.invalid-credentials")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	user.DeleteAfter = time.Now().AddDate(0, 0, Cfg.DeletionGraceDays)
+	if !saveAccountOrFail(w, req, user) {
+		return
+	}
+
+	Audit(AuditDeleteRequested, user.ID, user.Username, GetClientIP(req), "")
+
+	SendMail(user.Email, string(T(user.Locale, "mail.delete.subject")),
+		string(T(user.Locale, "mail.delete.body", user.Username, user.DeleteAfter.Format("2006-01-02"), Cfg.BaseURL+"/login")))
+
+	// They're logged out everywhere, logging back in lets them cancel
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	if err := endUserSessions(ctx, user, ""); err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+	deleteCookie(user, req, w)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "settings.delete.scheduled", user.DeleteAfter.Format("2006-01-02"))))
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
+
+func cancelDeleteAccountHandle(w http.ResponseWriter, req *http.Request) {
+	user, _ := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	if !user.DeleteAfter.IsZero() {
+		user.DeleteAfter = time.Time{}
+		if !saveAccountOrFail(w, req, user) {
+			return
+		}
+
+		Audit(AuditDeleteCancelled, user.ID, user.Username, GetClientIP(req), "")
+		CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "settings.delete.cancelled")))
+	}
+
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+}
+
+// Deletes the accounts whose grace period has run out, this runs for as long as the server does.
+func deletionReaper() {
+	for {
+		ctx, cancel := backgroundContext()
+		due, _ := GetUsersDueDeletionDB(ctx, time.Now())
+		cancel()
+
+		for _, user := range due {
+			// Left for next time
+			if err := deleteAccountData(user); err != nil {
+				log.Println("[!!] Failed to delete account", user.ID, ":", err)
+			}
+		}
+
+		time.Sleep(deletionReapInterval)
+	}
+}
+
+// Removes a user and anonymises anything left that refers to them
+func deleteAccountData(user *User) error {
+	ctx, cancel := backgroundContext()
+	defer cancel()
+
+	if err := endUserSessions(ctx, user, ""); err != nil {
+		return err
+	}
+
+	// The audit trail is kept, but no longer says who it was.
+	// This is all done before they are deleted so it is tried again if any of it fails.
+	if err := AnonymiseAuditDB(ctx, user); err != nil {
+		return err
+	}
+
+	// Nor does anything they did for others
+	if err := ClearInviteCreatorDB(ctx, user.ID); err != nil {
+		return err
+	}
+	if err := ClearInviterDB(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := DeleteUserDB(ctx, user); err != nil {
+		return err
+	}
+	Audit(AuditDeleted, "", "", "", "")
+
+	log.Printf("Deleted an account after its grace period")
+	return nil
+}
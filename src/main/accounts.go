@@ -1,30 +1,88 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/andanhm/go-prettytime"
-	"log"
-	"strings"
+	"net/http"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // User contains data about a user
 type User struct {
+	// ID never changes, so it is what anything else refers to them by.
+	ID string `bson:"uid"`
+
 	// Credentials
 	Email    string `bson:"email"`
 	Username string `bson:"username"`
 	Password []byte `bson:"password"`
+	// The username and email normalised, which is what they are looked up and kept unique by.
+	UsernameKey string `bson:"username_key"`
+	EmailKey    string `bson:"email_key"`
+
+	// Verification
+	Pending     bool      `bson:"pending"`
+	VerifyNonce string    `bson:"verifynonce"`
+	VerifySent  time.Time `bson:"verifysent"`
+
+	// Password reset, the token is only stored hashed.
+	ResetHash    string    `bson:"resethash"`
+	ResetExpires time.Time `bson:"resetexpires"`
+
+	// Two factor authentication, the pending secret is kept until setup is confirmed.
+	TOTPEnabled   bool     `bson:"totpenabled"`
+	TOTPSecret    string   `bson:"totpsecret"`
+	TOTPPending   string   `bson:"totppending"`
+	TOTPLastStep  int64    `bson:"totplaststep"`
+	RecoveryCodes []string `bson:"recoverycodes"`
+
+	// An email change waiting to be confirmed from the new address
+	PendingEmail string `bson:"pendingemail"`
+	EmailNonce   string `bson:"emailnonce"`
+
+	// DeleteAfter is when the account will be deleted, if they have asked for it to be.
+	DeleteAfter time.Time `bson:"deleteafter"`
+
+	// Previous usernames, kept so they stay reserved for a while and old links still work.
+	NameHistory []NameChange `bson:"namehistory"`
+	NameChanged time.Time    `bson:"namechanged"`
 
 	// Activity
-	Online   bool
+	Online   bool      `bson:"online"`
 	LastSeen time.Time `bson:"lastseen"`
+	// Presence is online, away or offline, worked out when they are looked up
+	Presence string `bson:"-" json:"-"`
+	// ImpersonatedBy is the admin viewing the site as them in this session, if any
+	ImpersonatedBy string `bson:"-" json:"-"`
+
+	// InvitedBy is the ID of whoever made the invite they signed up with
+	InvitedBy string `bson:"invitedby"`
 
 	// Misc
-	IsAdmin bool   `bson:"isadmin"`
-	Locale  string `bson:"locale"`
+	IsAdmin   bool   `bson:"isadmin"`
+	Locale    string `bson:"locale"`
 	GlobalTag string `bson:"globaltag"`
+
+	// Version goes up each time they are saved, so a save made from an older copy can be turned away.
+	Version int `bson:"version"`
+}
+
+// NameChange is a username a user used to have
+type NameChange struct {
+	Name      string    `bson:"name"`
+	Key       string    `bson:"key"`
+	ChangedAt time.Time `bson:"changedat"`
+}
+
+// AllNames returns their current username followed by any they have had before
+func (user User) AllNames() []string {
+	names := []string{user.Username}
+	for _, change := range user.NameHistory {
+		names = append(names, change.Name)
+	}
+	return names
 }
 
 // QualifiedName returns their qualified name including their prefix tag, if applicable.
@@ -58,7 +116,7 @@ func (user User) String() string {
 // var UserDB = map[string]*User{}
 
 // GetAccount gets a user from the database with the given query and returns them
-func GetAccount(query string, allowEmail bool) *User {
+func GetAccount(ctx context.Context, query string, allowEmail bool) (*User, error) {
 
 	/*
 		for _, u := range UserDB {
@@ -72,57 +130,98 @@ func GetAccount(query string, allowEmail bool) *User {
 	*/
 
 	var account *User
+	var err error
 
 	if allowEmail {
-		account = GetUserByEmailUsername(query)
+		account, err = GetUserByEmailUsername(ctx, query)
+	} else {
+		account, err = GetUserByName(ctx, query)
+	}
 
-		if account == nil {
-			return nil
-		}
+	if err != nil {
+		return nil, err
+	}
+
+	Presence.Apply(account)
+	return account, nil
+}
+
+// SaveAccount saves a userdata to db, giving ErrConflict if they have been saved elsewhere since they were read.
+// What is set on its own, such as when they were last seen, is kept as stored, see UserStore.Update.
+func SaveAccount(ctx context.Context, user *User) error {
+	// UserDB[strings.ToLower(user.Username)] = user
+	return UpdateUserDB(ctx, user)
+}
 
+// Saves a user while handling a request, showing the error instead and returning false if it couldn't be.
+func saveAccountOrFail(w http.ResponseWriter, req *http.Request, user *User) bool {
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	err := SaveAccount(ctx, user)
+	if err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return false
 	}
 
-	account = GetUserByName(query)
-	if account == nil {
-		return nil
+	return true
+}
+
+// Checks if a username is used by, or still reserved for, someone other than the user given.
+func usernameTaken(ctx context.Context, username string, self *User) (bool, error) {
+	current, err := GetUserByName(ctx, username)
+	if err == nil && (self == nil || current.ID != self.ID) {
+		return true, nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
 	}
 
-	onlineAccount := GetOnlineUser(account)
-	if onlineAccount == nil {
-		return account
+	previous, err := GetUserByPreviousName(ctx, username, nameReservation())
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return onlineAccount
+	return self == nil || previous.ID != self.ID, nil
 }
 
-// SaveAccount saves a userdata to db
-func SaveAccount(user *User) {
-	// UserDB[strings.ToLower(user.Username)] = user
-	UpdateUserDB(user)
+// How long an old username is kept for its previous owner
+func nameReservation() time.Duration {
+	return time.Duration(Cfg.NameReservationDays) * 24 * time.Hour
 }
 
-func createUser(locale string, email string, username string, password string) (*User, string) {
+// Creates a user, returning why not if they can't be. The error is only given when the database couldn't be used.
+func createUser(ctx context.Context, locale string, email string, username string, password string, invitedBy string) (*User, string, error) {
 	// Validation checks
 	if email == "" || !regexEmail.MatchString(email) {
-		return nil, string(T(locale, "error.email-invalid"))
+		return nil, string(T(locale, "error.email-invalid")), nil
 	}
 	if username == "" {
-		return nil, string(T(locale, "username.username-invalid"))
+		return nil, string(T(locale, "error.username-invalid")), nil
 	}
-	if len(password) < 6 {
-		return nil, string(T(locale, "error.password-invalid"))
+	if policyErr := Cfg.Password.Check(locale, password, username, email); policyErr != "" {
+		return nil, policyErr, nil
 	}
 
 	// Check if in use
 
-	similarEmail := GetUserByEmail(email)
-	if similarEmail != nil {
-		return nil, string(T(locale, "error.email-used"))
+	_, err := GetUserByEmail(ctx, email)
+	if err == nil {
+		return nil, string(T(locale, "error.email-used")), nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, "", err
 	}
 
-	similarUserName := GetUserByName(username)
-	if similarUserName != nil {
-		return nil, string(T(locale, "error.username-used"))
+	taken, err := usernameTaken(ctx, username, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if taken {
+		return nil, string(T(locale, "error.username-used")), nil
 	}
 
 	/*
@@ -138,42 +237,31 @@ func createUser(locale string, email string, username string, password string) (
 
 	securePass := hashSaltPassword([]byte(password))
 	if string(securePass) == password {
-		return nil, string(T(locale, "error.cannot-hash"))
+		return nil, string(T(locale, "error.cannot-hash")), nil
 	}
 
 	user := &User{
+		ID:       newUserID(),
 		Email:    email,
 		Username: username,
 		Password: securePass,
 		IsAdmin:  false,
 		Online:   true,
+		Pending:  true,
+
+		InvitedBy: invitedBy,
 	}
 	// UserDB[strings.ToLower(username)] = user
 
 	// insert to db
-	InsertUserDB(user)
-
-	return user, ""
-}
-
-func hashSaltPassword(password []byte) []byte {
-	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
-	if err != nil {
-		log.Println("[!!] Error hashing password. ", err)
-		return password
+	err = InsertUserDB(ctx, user)
+	if errors.Is(err, ErrDuplicate) {
+		// Someone took the email or username since it was checked
+		return nil, dataErrorMessage(locale, err), nil
 	}
-
-	return hash
-}
-
-func passMatch(hashed []byte, input []byte) bool {
-	err := bcrypt.CompareHashAndPassword(hashed, input)
 	if err != nil {
-		if !strings.Contains(err.Error(), "is not the hash of the given password") {
-			log.Println("[!!] Error comparing hashed password. ", err)
-		}
-		return false
+		return nil, "", err
 	}
 
-	return true
+	return user, "", nil
 }
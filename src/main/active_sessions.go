@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ActiveSession is a session as shown to the user who holds it
+type ActiveSession struct {
+	// ID identifies the session without giving away its key
+	ID      string
+	Current bool
+	UserAgent
+	IP           string
+	Country      string
+	Created      time.Time
+	LastActivity time.Time
+}
+
+// Gets the ID a session is shown under, the key itself is never put on a page.
+func sessionID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Gets every session of a user to show them, most recently used first
+func activeSessions(ctx context.Context, user *User, currentKey string) ([]ActiveSession, error) {
+	sessions, err := Sessions.UserSessions(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []ActiveSession
+	for _, session := range sessions {
+		active = append(active, ActiveSession{
+			ID:           sessionID(session.Key),
+			Current:      session.Key == currentKey,
+			UserAgent:    ParseUserAgent(session.UserAgent),
+			IP:           session.IP,
+			Country:      GetCountry(session.IP),
+			Created:      session.Created,
+			LastActivity: session.LastActivity,
+		})
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastActivity.After(active[j].LastActivity)
+	})
+
+	return active, nil
+}
+
+func sessionsHandle(w http.ResponseWriter, req *http.Request) {
+	user, sessionKey, err := GetSessionedUser(req, w)
+	if err != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	if req.Method == "POST" {
+		if blockImpersonation(w, req, user) {
+			return
+		}
+
+		switch req.FormValue("action") {
+		case "revoke":
+			id := req.FormValue("id")
+			sessions, err := Sessions.UserSessions(ctx, user.ID)
+			if err != nil {
+				serveDataError(w, req, user.Locale, err)
+				return
+			}
+
+			for _, session := range sessions {
+				// Their own session is ended by logging out
+				if sessionID(session.Key) == id && session.Key != sessionKey {
+					if err := endSession(ctx, session); err != nil {
+						serveDataError(w, req, user.Locale, err)
+						return
+					}
+					log.Printf("%s revoked one of their sessions", user.Username)
+					CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "sessions.revoked")))
+				}
+			}
+
+		case "revoke-others":
+			if err := endUserSessions(ctx, user, sessionKey); err != nil {
+				serveDataError(w, req, user.Locale, err)
+				return
+			}
+			log.Printf("%s signed out everywhere else", user.Username)
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "sessions.revoked-others")))
+		}
+
+		http.Redirect(w, req, "/settings/sessions", http.StatusSeeOther)
+		return
+	}
+
+	sessions, dataErr := activeSessions(ctx, user, sessionKey)
+	if dataErr != nil {
+		serveDataError(w, req, user.Locale, dataErr)
+		return
+	}
+
+	viewData := &ViewData{
+		Viewer: user,
+		Data: map[string]interface{}{
+			"sessions": sessions,
+		},
+	}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "sessions.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing sessions template:", templateErr)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Gets the requesting user if they are an admin, otherwise sends them away.
+func getAdmin(w http.ResponseWriter, req *http.Request) *User {
+	user, _, err := GetSessionedUser(req, w)
+	if err != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	if !user.IsAdmin {
+		http.Redirect(w, req, "/404", http.StatusSeeOther)
+		return nil
+	}
+
+	return user
+}
+
+// AdminInvite is an invite as shown to admins, along with the current name of whoever made it
+type AdminInvite struct {
+	Invite
+	Creator string
+}
+
+// Gets every invite to show admins. Creators whose accounts have gone are left blank.
+func adminInvites(ctx context.Context) ([]AdminInvite, error) {
+	invites, err := GetInvitesDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	shown := make([]AdminInvite, 0, len(invites))
+	for _, invite := range invites {
+		name, ok := names[invite.CreatedBy]
+		if !ok && invite.CreatedBy != "" {
+			creator, err := GetUserByID(ctx, invite.CreatedBy)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+			if creator != nil {
+				name = creator.Username
+			}
+			names[invite.CreatedBy] = name
+		}
+
+		shown = append(shown, AdminInvite{Invite: invite, Creator: name})
+	}
+
+	return shown, nil
+}
+
+func adminHandle(w http.ResponseWriter, req *http.Request) {
+	user := getAdmin(w, req)
+	if user == nil {
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	if req.Method == "POST" {
+		switch req.FormValue("action") {
+		case "require-2fa":
+			require := req.FormValue("require") == "on"
+			UpdateSite(func(settings *SiteSettings) {
+				settings.RequireAdmin2FA = require
+			})
+
+			log.Printf("%s set admin 2fa requirement to %t", user.Username, require)
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "admin.saved")))
+
+		case "signup-mode":
+			mode := req.FormValue("mode")
+			if mode != SignupOpen && mode != SignupInvite && mode != SignupClosed {
+				break
+			}
+
+			UpdateSite(func(settings *SiteSettings) {
+				settings.SignupMode = mode
+			})
+
+			log.Printf("%s set signup mode to %s", user.Username, mode)
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "admin.saved")))
+
+		case "create-invite":
+			maxUses, _ := strconv.Atoi(req.FormValue("uses"))
+			days, _ := strconv.Atoi(req.FormValue("days"))
+			if maxUses < 1 || days < 1 {
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "admin.invite-invalid")))
+				break
+			}
+
+			invite, err := CreateInvite(ctx, user, maxUses, time.Duration(days)*24*time.Hour, req.FormValue("email"))
+			if err != nil {
+				serveDataError(w, req, user.Locale, err)
+				return
+			}
+
+			log.Printf("%s created an invite for %d uses", user.Username, maxUses)
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "admin.invite-created", invite.Code)))
+
+		case "revoke-invite":
+			err := DeleteInviteDB(ctx, req.FormValue("code"))
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				serveDataError(w, req, user.Locale, err)
+				return
+			}
+
+			log.Printf("%s revoked invite %s", user.Username, req.FormValue("code"))
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "admin.invite-revoked")))
+		}
+
+		http.Redirect(w, req, "/admin", http.StatusSeeOther)
+		return
+	}
+
+	invites, err := adminInvites(ctx)
+	if err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+
+	viewData := &ViewData{
+		Viewer: user,
+		Data: map[string]interface{}{
+			"site":    Site(),
+			"invites": invites,
+		},
+	}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "admin.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing admin template:", templateErr)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// LoginAttempts is the record of failed logins against an account or address
+type LoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"lastfailure"`
+	// Expires is when the record is forgotten about if there are no more failures
+	Expires time.Time `bson:"expires"`
+}
+
+// AttemptCounter keeps count of failed logins. Each attempt is counted as a failure before it is checked,
+// so guesses made at the same time can't all get in before any of them are counted.
+// Any failure to reach the store gives ErrUnavailable.
+type AttemptCounter interface {
+	// Reserve counts an attempt against a key, returning the record from before it to work out if it is allowed
+	Reserve(ctx context.Context, key string) (LoginAttempts, error)
+	// Release gives back an attempt that didn't fail, given the record Reserve returned for it
+	Release(ctx context.Context, key string, previous LoginAttempts) error
+	// Reset forgets about any failures for a key
+	Reset(ctx context.Context, key string) error
+}
+
+// Attempts is the counter used for logins
+var Attempts AttemptCounter
+
+func attemptsInit() {
+	switch Cfg.Security.AttemptStore {
+	case "mongo":
+		Attempts = newMongoAttemptCounter()
+	default:
+		Attempts = &memoryAttemptCounter{records: map[string]LoginAttempts{}}
+	}
+}
+
+// How long failures are remembered for after the last one
+func attemptMemory() time.Duration {
+	return time.Duration(Cfg.Security.LockoutMinutes) * time.Minute
+}
+
+// memoryAttemptCounter keeps counts in memory, which is fine when there's one node.
+type memoryAttemptCounter struct {
+	lock    sync.Mutex
+	records map[string]LoginAttempts
+}
+
+func (c *memoryAttemptCounter) Reserve(ctx context.Context, key string) (LoginAttempts, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	record, ok := c.records[key]
+	if !ok || now.After(record.Expires) {
+		record = LoginAttempts{Key: key}
+	}
+	previous := record
+
+	record.Failures++
+	record.LastFailure = now
+	record.Expires = now.Add(attemptMemory())
+	c.records[key] = record
+
+	return previous, nil
+}
+
+func (c *memoryAttemptCounter) Release(ctx context.Context, key string, previous LoginAttempts) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	record, ok := c.records[key]
+	if !ok || record.Failures == 0 {
+		return nil
+	}
+
+	// Nothing else was tried since, so it goes back to how it was
+	if record.Failures == previous.Failures+1 {
+		if previous.Failures == 0 {
+			delete(c.records, key)
+		} else {
+			c.records[key] = previous
+		}
+		return nil
+	}
+
+	record.Failures--
+	c.records[key] = record
+	return nil
+}
+
+func (c *memoryAttemptCounter) Reset(ctx context.Context, key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.records, key)
+	return nil
+}
+
+// mongoAttemptCounter keeps counts in the database so they are shared between nodes.
+type mongoAttemptCounter struct{}
+
+func newMongoAttemptCounter() *mongoAttemptCounter {
+	// Records delete themselves once expired
+	err := attemptCollection().EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		log.Println("[!!] Failed to create login attempt index:", err)
+	}
+
+	return &mongoAttemptCounter{}
+}
+
+func (c *mongoAttemptCounter) Reserve(ctx context.Context, key string) (LoginAttempts, error) {
+	now := time.Now()
+
+	var previous LoginAttempts
+	err := mongoCall(ctx, func() error {
+		// Start from scratch if the old record has run out, the TTL monitor only runs every so often
+		err := attemptCollection().Remove(bson.M{"_id": key, "expires": bson.M{"$lt": now}})
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+
+		// The record from before is given back, which is left empty if there wasn't one
+		_, err = attemptCollection().FindId(key).Apply(mgo.Change{
+			Update: bson.M{
+				"$inc": bson.M{"failures": 1},
+				"$set": bson.M{"lastfailure": now, "expires": now.Add(attemptMemory())},
+			},
+			Upsert: true,
+		}, &previous)
+		return err
+	})
+	previous.Key = key
+
+	return previous, err
+}
+
+func (c *mongoAttemptCounter) Release(ctx context.Context, key string, previous LoginAttempts) error {
+	err := mongoCall(ctx, func() error {
+		// Nothing else was tried since, so it goes back to how it was
+		untouched := bson.M{"_id": key, "failures": previous.Failures + 1}
+		var err error
+		if previous.Failures == 0 {
+			err = attemptCollection().Remove(untouched)
+		} else {
+			err = attemptCollection().Update(untouched, bson.M{"$set": bson.M{
+				"failures":    previous.Failures,
+				"lastfailure": previous.LastFailure,
+				"expires":     previous.Expires,
+			}})
+		}
+		if err != mgo.ErrNotFound {
+			return err
+		}
+
+		return attemptCollection().Update(
+			bson.M{"_id": key, "failures": bson.M{"$gt": 0}},
+			bson.M{"$inc": bson.M{"failures": -1}},
+		)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (c *mongoAttemptCounter) Reset(ctx context.Context, key string) error {
+	err := mongoCall(ctx, func() error {
+		return attemptCollection().RemoveId(key)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Throttle works out whether a login should be refused and for how long, from the failures so far.
+// The wait doubles with each failure until the limit is hit, then they are locked out.
+func (a LoginAttempts) Throttle(maxFailures int) (wait time.Duration, locked bool) {
+	if a.Failures == 0 {
+		return 0, false
+	}
+
+	if a.Failures >= maxFailures {
+		return time.Until(a.Expires), true
+	}
+
+	delay := float64(Cfg.Security.BaseDelaySeconds) * math.Pow(2, float64(a.Failures-1))
+	delay = math.Min(delay, float64(Cfg.Security.MaxDelaySeconds))
+
+	return time.Until(a.LastFailure.Add(time.Duration(delay) * time.Second)), false
+}
+
+// Keys login attempts are counted against. Accounts are counted by ID so changing their name doesn't reset it,
+// names nobody has are counted by the name.
+func accountAttemptKey(userID string, username string) string {
+	if userID != "" {
+		return "account:id:" + userID
+	}
+	return "account:name:" + NormalizeKey(username)
+}
+
+func ipAttemptKey(req *http.Request) string {
+	return "ip:" + GetClientIP(req)
+}
+
+// LoginAttempt is a login being tried, already counted as failed against the address and account until it is known not to be.
+type LoginAttempt struct {
+	req      *http.Request
+	userID   string
+	username string
+	// The records from before it was counted, for each key
+	previous map[string]LoginAttempts
+}
+
+// attemptLimit is a key a login is counted against and how many failures it is allowed
+type attemptLimit struct {
+	key         string
+	maxFailures int
+}
+
+func (a *LoginAttempt) limits() []attemptLimit {
+	return []attemptLimit{
+		{ipAttemptKey(a.req), Cfg.Security.MaxIPFailures},
+		{accountAttemptKey(a.userID, a.username), Cfg.Security.MaxFailures},
+	}
+}
+
+// BeginLoginAttempt counts a login against its address and account before it is checked, returning a translated error if it
+// isn't allowed right now. The user ID is left empty when nobody has the username tried.
+// Logins aren't allowed while the counts can't be kept.
+func BeginLoginAttempt(ctx context.Context, req *http.Request, locale string, userID string, username string) (*LoginAttempt, string, error) {
+	attempt := &LoginAttempt{req: req, userID: userID, username: username, previous: map[string]LoginAttempts{}}
+
+	refused := ""
+	for _, check := range attempt.limits() {
+		record, err := Attempts.Reserve(ctx, check.key)
+		if err != nil {
+			attempt.Release(ctx)
+			return nil, "", err
+		}
+		attempt.previous[check.key] = record
+
+		wait, locked := record.Throttle(check.maxFailures)
+		if wait <= 0 || refused != "" {
+			continue
+		}
+
+		if locked {
+			refused = string(T(locale, "error.locked-out", int(math.Ceil(wait.Minutes()))))
+		} else {
+			refused = string(T(locale, "error.too-fast", int(math.Ceil(wait.Seconds()))))
+		}
+	}
+
+	// Turned away without being tried, so it isn't counted
+	if refused != "" {
+		attempt.Release(ctx)
+		return nil, refused, nil
+	}
+
+	return attempt, "", nil
+}
+
+// Release gives back the attempt without it counting as failed, for when it wasn't finished.
+func (a *LoginAttempt) Release(ctx context.Context) {
+	for key, previous := range a.previous {
+		if err := Attempts.Release(ctx, key, previous); err != nil {
+			log.Printf("[!!] Failed to give back login attempt for %s: %s", key, err)
+		}
+	}
+}
+
+// Fail keeps the attempt counted as failed, noting down if that has locked out the address or account.
+func (a *LoginAttempt) Fail(reason string) {
+	ip := GetClientIP(a.req)
+	Audit(AuditLoginFailed, a.userID, a.username, ip, reason)
+
+	for _, check := range a.limits() {
+		if a.previous[check.key].Failures+1 != check.maxFailures {
+			continue
+		}
+
+		if check.key == ipAttemptKey(a.req) {
+			Audit(AuditLockout, "", "", ip, "address locked out")
+		} else {
+			Audit(AuditLockout, a.userID, a.username, ip, "account locked out")
+		}
+	}
+}
+
+// Succeed clears failures against the account once they get in.
+// The address only gets back this attempt, so one good account can't be used to keep guessing at others.
+func (a *LoginAttempt) Succeed(ctx context.Context, user *User) {
+	Audit(AuditLoginSuccess, user.ID, user.Username, GetClientIP(a.req), "")
+
+	ipKey := ipAttemptKey(a.req)
+	if err := Attempts.Release(ctx, ipKey, a.previous[ipKey]); err != nil {
+		log.Printf("[!!] Failed to give back login attempt for %s: %s", ipKey, err)
+	}
+	if err := Attempts.Reset(ctx, accountAttemptKey(user.ID, user.Username)); err != nil {
+		log.Printf("[!!] Failed to reset login attempts for %s: %s", user.Username, err)
+	}
+}
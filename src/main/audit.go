@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// AuditLoginSuccess is logged when someone logs in
+	AuditLoginSuccess = "login.success"
+	// AuditLoginFailed is logged when a login fails
+	AuditLoginFailed = "login.failed"
+	// AuditRememberTheft is logged when a remember me token is used after it was replaced
+	AuditRememberTheft = "login.remember-theft"
+	// AuditLockout is logged when an account or address gets locked out
+	AuditLockout = "login.lockout"
+	// AuditImpersonateStart is logged when an admin starts viewing the site as someone else
+	AuditImpersonateStart = "admin.impersonate-start"
+	// AuditImpersonateStop is logged when they go back to their own account
+	AuditImpersonateStop = "admin.impersonate-stop"
+	// AuditEmailChangeRequested is logged when someone asks to change their email
+	AuditEmailChangeRequested = "account.email-change-requested"
+	// AuditEmailChanged is logged when an email change is confirmed
+	AuditEmailChanged = "account.email-changed"
+	// AuditEmailChangeCancelled is logged when an email change is cancelled from the old address
+	AuditEmailChangeCancelled = "account.email-change-cancelled"
+	// AuditExport is logged when someone downloads their data
+	AuditExport = "account.export"
+	// AuditDeleteRequested is logged when someone asks for their account to be deleted
+	AuditDeleteRequested = "account.delete-requested"
+	// AuditDeleteCancelled is logged when someone changes their mind about deleting their account
+	AuditDeleteCancelled = "account.delete-cancelled"
+	// AuditDeleted is logged once an account has been deleted
+	AuditDeleted = "account.deleted"
+)
+
+// AuditEvent is a security related event kept for later review
+type AuditEvent struct {
+	Time  time.Time `bson:"time" json:"time"`
+	Event string    `bson:"event" json:"event"`
+	// UserID is who it happened to, Username is what they were called at the time.
+	// Events against a name nobody has, such as failed logins, only have the name.
+	UserID   string `bson:"userid" json:"user_id"`
+	Username string `bson:"username" json:"username"`
+	IP       string `bson:"ip" json:"ip"`
+	Detail   string `bson:"detail" json:"detail"`
+	// TargetID is who it was done to, for events one user does to another.
+	TargetID string `bson:"targetid,omitempty" json:"target_id,omitempty"`
+}
+
+// Audit records a security event to the log and the audit collection
+func Audit(event string, userID string, username string, ip string, detail string) {
+	log.Printf("[AUDIT] %s user:%s (%s) ip:%s %s", event, username, userID, ip, detail)
+
+	insertAudit(&AuditEvent{
+		Time:     time.Now(),
+		Event:    event,
+		UserID:   userID,
+		Username: username,
+		IP:       ip,
+		Detail:   detail,
+	})
+}
+
+// AuditOn records a security event one user did to another, such as an admin viewing the site as them.
+func AuditOn(event string, userID string, username string, target *User, ip string) {
+	detail := "as " + target.Username
+	log.Printf("[AUDIT] %s user:%s (%s) target:%s ip:%s %s", event, username, userID, target.ID, ip, detail)
+
+	insertAudit(&AuditEvent{
+		Time:     time.Now(),
+		Event:    event,
+		UserID:   userID,
+		Username: username,
+		IP:       ip,
+		Detail:   detail,
+		TargetID: target.ID,
+	})
+}
+
+// Saves an audit event outside of the request, so it isn't lost if whoever caused it goes away first.
+// It is already in the log if this fails.
+func insertAudit(event *AuditEvent) {
+	ctx, cancel := backgroundContext()
+	defer cancel()
+
+	InsertAuditDB(ctx, event)
+}
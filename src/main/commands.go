@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const commandUsage = `Usage:
+  smark                        runs the server
+  smark migrate up [-dry-run]  applies any migrations not yet applied
+  smark migrate status         lists migrations and when they were applied`
+
+// Runs a command given on the command line instead of the server, returning the exit code.
+func runCommand(args []string) int {
+	if args[0] == "migrate" && len(args) > 1 {
+		switch args[1] {
+		case "up":
+			return migrateUpCommand(args[2:])
+		case "status":
+			return migrateStatusCommand()
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, commandUsage)
+	return 2
+}
+
+func migrateUpCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate up", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only show what would be changed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	record, list := migrationLog()
+
+	var applied []int
+	var err error
+	if *dryRun {
+		applied, err = migrate(context.Background(), record, list, true)
+	} else {
+		applied, err = migrateLocked(context.Background(), record, list, 0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to migrate:", err)
+		return 1
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("Already up to date.")
+	}
+	return 0
+}
+
+func migrateStatusCommand() int {
+	record, list := migrationLog()
+
+	status, err := migrationStatus(context.Background(), record, list)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get migrations:", err)
+		return 1
+	}
+
+	for _, migration := range status {
+		applied := "pending"
+		if !migration.Applied.IsZero() {
+			applied = migration.Applied.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-20s  %s\n", migration.Version, applied, migration.Name)
+	}
+	return 0
+}
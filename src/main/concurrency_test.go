@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These are run with -race, many requests use each of these at once.
+const stressWorkers = 16
+const stressRounds = 200
+
+// Runs work from many goroutines at once and waits for them all
+func stress(work func(worker int, round int)) {
+	var wait sync.WaitGroup
+	for worker := 0; worker < stressWorkers; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for round := 0; round < stressRounds; round++ {
+				work(worker, round)
+			}
+		}(worker)
+	}
+	wait.Wait()
+}
+
+func TestLocaleCacheConcurrent(t *testing.T) {
+	cache := newLocaleCache()
+
+	stress(func(worker int, round int) {
+		ip := fmt.Sprintf("10.0.%d.%d", worker, round%8)
+		cache.Set(ip, "US")
+		if locale := cache.Get(ip); locale != "US" {
+			t.Errorf("got %q for %s", locale, ip)
+		}
+	})
+}
+
+func TestMemorySessionStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := &memorySessionStore{sessions: map[string]*Session{}}
+
+	stress(func(worker int, round int) {
+		userID := fmt.Sprintf("user-%d", worker%4)
+		key := fmt.Sprintf("%d-%d", worker, round)
+
+		store.Save(ctx, &Session{Key: key, UserID: userID, LastActivity: time.Now(), Expires: time.Now().Add(time.Minute)})
+
+		if session, err := store.Get(ctx, key); err == nil {
+			session.LastActivity = time.Now()
+			store.Save(ctx, session)
+		}
+
+		store.UserSessions(ctx, userID)
+		if round%10 == 0 {
+			store.DeleteUser(ctx, userID, key)
+		}
+		if round%25 == 0 {
+			store.RemoveExpired(ctx)
+		}
+		store.Delete(ctx, key)
+	})
+}
+
+func TestSiteSettingsConcurrent(t *testing.T) {
+	siteSettingsPath = filepath.Join(t.TempDir(), "settings.json")
+	defer func() { siteSettingsPath = "settings.json" }()
+
+	modes := []string{SignupOpen, SignupInvite, SignupClosed}
+	admin := &User{IsAdmin: true}
+
+	stress(func(worker int, round int) {
+		if worker%4 == 0 {
+			UpdateSite(func(settings *SiteSettings) {
+				settings.SignupMode = modes[round%len(modes)]
+				settings.RequireAdmin2FA = round%2 == 0
+			})
+			return
+		}
+
+		mode := Site().SignupMode
+		if mode != SignupOpen && mode != SignupInvite && mode != SignupClosed {
+			t.Errorf("read signup mode %q", mode)
+		}
+		Needs2FASetup(admin)
+	})
+
+	UpdateSite(func(settings *SiteSettings) {
+		*settings = SiteSettings{SignupMode: SignupOpen}
+	})
+}
+
+func TestTouchDoesNotReviveEndedSession(t *testing.T) {
+	ctx := context.Background()
+	store := &memorySessionStore{sessions: map[string]*Session{}}
+
+	now := time.Now()
+	store.Save(ctx, &Session{Key: "key", UserID: "user", LastActivity: now, Expires: now.Add(time.Minute)})
+	record, _ := store.Get(ctx, "key")
+
+	// Logged out while a request using it was still going
+	store.Delete(ctx, "key")
+
+	record.LastActivity = now.Add(time.Minute)
+	record.Expires = now.Add(time.Hour)
+	if err := store.Touch(ctx, record); !errors.Is(err, ErrNotFound) {
+		t.Errorf("touching an ended session gave %v, want not found", err)
+	}
+	if _, err := store.Get(ctx, "key"); !errors.Is(err, ErrNotFound) {
+		t.Error("touching an ended session brought it back")
+	}
+}
+
+func TestLoginAttemptsReservedAtOnce(t *testing.T) {
+	ctx := context.Background()
+	counter := &memoryAttemptCounter{records: map[string]LoginAttempts{}}
+
+	// Guesses made together, only one of which should be let through before the wait starts
+	var lock sync.Mutex
+	allowed := 0
+	stress(func(worker int, round int) {
+		if round > 0 {
+			return
+		}
+
+		previous, _ := counter.Reserve(ctx, "account:id:1")
+		if wait, _ := previous.Throttle(Cfg.Security.MaxFailures); wait > 0 {
+			counter.Release(ctx, "account:id:1", previous)
+			return
+		}
+
+		lock.Lock()
+		allowed++
+		lock.Unlock()
+	})
+
+	if allowed != 1 {
+		t.Errorf("%d guesses made at once were let through", allowed)
+	}
+	if previous, _ := counter.Reserve(ctx, "account:id:1"); previous.Failures != 1 {
+		t.Errorf("%d failures counted, want only the guess let through", previous.Failures)
+	}
+}
+
+func TestSQLiteUserStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLiteUsers(t)
+	user := insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+	// Presence flushes and requests write at the same time, which SQLite must queue rather than call busy
+	stress(func(worker int, round int) {
+		if round >= 10 {
+			return
+		}
+
+		var err error
+		switch worker % 3 {
+		case 0:
+			err = store.SetLastSeen(ctx, map[string]time.Time{user.ID: time.Now()})
+		case 1:
+			err = store.SetLocale(ctx, user.ID, "DE")
+		default:
+			_, err = store.GetByID(ctx, user.ID)
+		}
+		if err != nil {
+			t.Errorf("worker %d: %v", worker, err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+// Config contains the settings loaded from config.json
+type Config struct {
+	// BaseURL is the public address of the site, used when building links sent out in emails.
+	BaseURL string `json:"base_url"`
+
+	Mail MailConfig `json:"mail"`
+
+	// VerifyExpiryHours is how long an email verification link stays valid for.
+	VerifyExpiryHours int `json:"verify_expiry_hours"`
+	// ResetExpiryMinutes is how long a password reset link stays valid for.
+	ResetExpiryMinutes int `json:"reset_expiry_minutes"`
+	// DeletionGraceDays is how long a user has to change their mind after asking to delete their account.
+	DeletionGraceDays int `json:"deletion_grace_days"`
+	// UsernameCooldownDays is how long a user has to wait between changing their username.
+	UsernameCooldownDays int `json:"username_cooldown_days"`
+	// NameReservationDays is how long an old username is kept from anyone else, and redirects to the new one.
+	NameReservationDays int `json:"name_reservation_days"`
+
+	Storage  StorageConfig  `json:"storage"`
+	Security SecurityConfig `json:"security"`
+	Sessions SessionConfig  `json:"sessions"`
+	Cookies  CookieConfig   `json:"cookies"`
+	Presence PresenceConfig `json:"presence"`
+	Password PasswordPolicy `json:"password"`
+	Hashing  HashPolicy     `json:"hashing"`
+}
+
+// MailConfig contains the settings of the mailer
+type MailConfig struct {
+	// Transport is either "smtp", "file" or "log"
+	Transport string `json:"transport"`
+	From      string `json:"from"`
+
+	// SMTP settings
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"pwd"`
+
+	// File is where mail is written to when using the file transport
+	File string `json:"file"`
+}
+
+// StorageConfig contains where accounts are kept
+type StorageConfig struct {
+	// Users is "mongo", "sqlite", "postgres" or "memory" for trying things out without a database.
+	Users string `json:"users"`
+	// DSN is the database to connect to for sqlite and postgres, a file name for sqlite.
+	DSN string `json:"dsn"`
+}
+
+// SecurityConfig contains the settings for protecting logins
+type SecurityConfig struct {
+	// AttemptStore is where failed logins are counted, "memory" or "mongo" when running several nodes.
+	AttemptStore string `json:"attempt_store"`
+	// MaxFailures is how many failed logins an account can have before it is locked out
+	MaxFailures int `json:"max_failures"`
+	// MaxIPFailures is how many failed logins an address can have before it is locked out
+	MaxIPFailures int `json:"max_ip_failures"`
+	// LockoutMinutes is how long a lockout lasts, and how long failures are remembered for
+	LockoutMinutes int `json:"lockout_minutes"`
+	// BaseDelaySeconds is the wait after the first failure, which doubles each time up to MaxDelaySeconds.
+	BaseDelaySeconds int `json:"base_delay_seconds"`
+	MaxDelaySeconds  int `json:"max_delay_seconds"`
+	// TrustedProxies are the addresses, or ranges like 10.0.0.0/8, of proxies in front of the site.
+	// X-Forwarded-For is only believed from these, so without any every request counts as from who connected.
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// SessionConfig contains the settings for logged in sessions
+type SessionConfig struct {
+	// Store is where sessions are kept, "memory" or "mongo" to keep them over restarts and between nodes.
+	Store string `json:"store"`
+	// IdleHours is how long a session lasts without being used, each use starts this again.
+	IdleHours int `json:"idle_hours"`
+	// MaxAgeDays is the longest a session can last however much it is used
+	MaxAgeDays int `json:"max_age_days"`
+	// RememberDays is how long "remember me" keeps someone logged in for after they last used it
+	RememberDays int `json:"remember_days"`
+}
+
+// CookieConfig contains the options every cookie is given
+type CookieConfig struct {
+	// KeyFile holds the keys cookies are signed and encrypted with, see CookieKeys
+	KeyFile string `json:"key_file"`
+	// Domain is the domain cookies are set for, empty leaves it to the browser.
+	// Set it when the site is reachable under several hosts so they share one session.
+	Domain string `json:"domain"`
+	// Secure only sends cookies over https, it is always on when BaseURL is https
+	Secure bool `json:"secure"`
+	// SameSite is "lax", "strict" or "none"
+	SameSite   string `json:"same_site"`
+	MaxAgeDays int    `json:"max_age_days"`
+}
+
+// PresenceConfig contains the settings for showing who is online
+type PresenceConfig struct {
+	// AwayMinutes is how long without any activity before someone shows as away
+	AwayMinutes int `json:"away_minutes"`
+	// OfflineMinutes is how long without any activity before someone shows as offline
+	OfflineMinutes int `json:"offline_minutes"`
+	// HeartbeatSeconds is how often open pages tell us they are still being looked at
+	HeartbeatSeconds int `json:"heartbeat_seconds"`
+	// FlushSeconds is how often activity is written to the database
+	FlushSeconds int `json:"flush_seconds"`
+}
+
+// Cfg is the loaded configuration
+var Cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		BaseURL: "http://localhost:8080",
+		Mail: MailConfig{
+			Transport: "log",
+			From:      "smark@localhost",
+		},
+		VerifyExpiryHours:    24,
+		ResetExpiryMinutes:   60,
+		DeletionGraceDays:    14,
+		UsernameCooldownDays: 30,
+		NameReservationDays:  90,
+		Storage: StorageConfig{
+			Users: "mongo",
+		},
+		Security: SecurityConfig{
+			AttemptStore:     "memory",
+			MaxFailures:      10,
+			MaxIPFailures:    50,
+			LockoutMinutes:   15,
+			BaseDelaySeconds: 1,
+			MaxDelaySeconds:  30,
+		},
+		Sessions: SessionConfig{
+			Store:        "memory",
+			IdleHours:    72,
+			MaxAgeDays:   30,
+			RememberDays: 30,
+		},
+		Cookies: CookieConfig{
+			KeyFile:    "session_keys.json",
+			SameSite:   "lax",
+			MaxAgeDays: 30,
+		},
+		Presence: PresenceConfig{
+			AwayMinutes:      5,
+			OfflineMinutes:   15,
+			HeartbeatSeconds: 60,
+			FlushSeconds:     30,
+		},
+		Password: PasswordPolicy{
+			MinLength:      8,
+			MaxLength:      72,
+			RejectIdentity: true,
+		},
+		Hashing: HashPolicy{
+			Algorithm:     HashBcrypt,
+			BcryptCost:    12,
+			Argon2Time:    3,
+			Argon2Memory:  64 * 1024,
+			Argon2Threads: 2,
+			Argon2KeyLen:  32,
+		},
+	}
+}
+
+func configInit() {
+	data, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		log.Println("[!!] No config.json found, using defaults.", err)
+		return
+	}
+
+	err = json.Unmarshal(data, &Cfg)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	trustedProxies, err = parseTrustedProxies(Cfg.Security.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if Cfg.Hashing.Algorithm != HashArgon2id {
+		Cfg.Hashing.Algorithm = HashBcrypt
+	}
+	if err := Cfg.Hashing.Validate(); err != nil {
+		log.Fatal("Invalid hashing config: ", err)
+	}
+
+	log.Println("Loaded config")
+}
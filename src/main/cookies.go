@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// The old single key file, only read if there's no key file set up
+const legacyKeyFile = "sess_key.txt"
+
+// CookieKeys is the key file, the current keys sign new cookies while previous ones are still accepted.
+// Keys are base64 encoded, encryption keys must be 16, 24 or 32 bytes long.
+type CookieKeys struct {
+	Current  CookieKeyPair   `json:"current"`
+	Previous []CookieKeyPair `json:"previous"`
+}
+
+// CookieKeyPair is a key to sign cookies with and a key to encrypt them with
+type CookieKeyPair struct {
+	Auth    string `json:"auth"`
+	Encrypt string `json:"encrypt"`
+}
+
+// Turns the key pairs into the order the cookie store wants, current keys first.
+func (keys CookieKeys) pairs() ([][]byte, error) {
+	var pairs [][]byte
+	for _, pair := range append([]CookieKeyPair{keys.Current}, keys.Previous...) {
+		auth, err := base64.StdEncoding.DecodeString(pair.Auth)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypt, err := base64.StdEncoding.DecodeString(pair.Encrypt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(auth) < 32 {
+			log.Println("[!!] A cookie signing key is shorter than 32 bytes.")
+		}
+
+		// Empty encryption keys leave cookies signed only, any other length would fail every cookie.
+		switch len(encrypt) {
+		case 0:
+			encrypt = nil
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("encryption key is %d bytes long, it must be 16, 24 or 32", len(encrypt))
+		}
+
+		pairs = append(pairs, auth, encrypt)
+	}
+
+	return pairs, nil
+}
+
+// Loads the cookie keys, falling back to the old single key file which only signs cookies
+func loadCookieKeys() [][]byte {
+	data, err := ioutil.ReadFile(Cfg.Cookies.KeyFile)
+	if err != nil {
+		log.Printf("[!!] No %s found, falling back to %s without encryption.", Cfg.Cookies.KeyFile, legacyKeyFile)
+
+		key, err := ioutil.ReadFile(legacyKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return [][]byte{key, nil}
+	}
+
+	var keys CookieKeys
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pairs, err := keys.pairs()
+	if err != nil {
+		log.Fatal("Failed to read cookie keys: ", err)
+	}
+
+	log.Printf("Loaded cookie keys with %d previous keys still accepted", len(keys.Previous))
+	return pairs
+}
+
+// Canonicalises a cookie domain, so the same site isn't given different cookies under different spellings.
+func canonicalCookieDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, ".")
+	domain = strings.TrimSuffix(domain, ".")
+
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+
+	// Browsers won't take a domain for localhost or an address
+	if domain == "localhost" || net.ParseIP(domain) != nil {
+		return ""
+	}
+
+	return domain
+}
+
+// Works out the options every cookie is given
+func cookieOptions() *sessions.Options {
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(Cfg.Cookies.SameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	// Cookies without Secure are ignored with SameSite=None, and any site served over https should have it anyway
+	secure := Cfg.Cookies.Secure || sameSite == http.SameSiteNoneMode || strings.HasPrefix(Cfg.BaseURL, "https://")
+
+	return &sessions.Options{
+		Path:     "/",
+		Domain:   canonicalCookieDomain(Cfg.Cookies.Domain),
+		MaxAge:   Cfg.Cookies.MaxAgeDays * 24 * 60 * 60,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	gContext "github.com/gorilla/context"
+)
+
+const (
+	// csrfFieldName is the form field the token is sent back in
+	csrfFieldName = "csrf_token"
+	// csrfHeaderName can be used instead of the form field
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+type csrfContextKey struct{}
+
+// Gets the CSRF token of a request. Logged in users have theirs kept with their session, made again each time they log in,
+// so a token planted in their browser beforehand is no use. Anyone else is given one in a cookie if they don't have one yet.
+func loadCSRFToken(req *http.Request, w http.ResponseWriter) string {
+	if token, ok := sessionCSRFToken(req); ok {
+		return token
+	}
+
+	session, _ := cookies.Get(req, "csrf")
+
+	token, _ := session.Values["token"].(string)
+	if token == "" {
+		token = generateSessionKey()
+		session.Values["token"] = token
+
+		err := session.Save(req, w)
+		if err != nil {
+			log.Println("[!!] Failed to save csrf token:", err)
+		}
+	}
+
+	return token
+}
+
+// Gets the CSRF token kept with the session of a request, if it has one
+func sessionCSRFToken(req *http.Request) (string, bool) {
+	session, err := cookies.Get(req, "session-id")
+	if err != nil {
+		return "", false
+	}
+	key, _ := session.Values["id"].(string)
+	if key == "" {
+		return "", false
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	record, err := Sessions.Get(ctx, key)
+	// Their session has run out, so they are a guest until they log in again
+	if errors.Is(err, ErrNotFound) {
+		return "", false
+	}
+	// Nothing can be checked against, so forms are turned away until it is back
+	if err != nil {
+		log.Println("[!!] Failed to get csrf token of session:", err)
+		return "", true
+	}
+
+	// Sessions from before tokens were kept with them
+	if record.CSRFToken == "" {
+		record.CSRFToken = generateSessionKey()
+		if err := Sessions.Save(ctx, record); err != nil {
+			log.Println("[!!] Failed to save csrf token of session:", err)
+			return "", true
+		}
+	}
+
+	return record.CSRFToken, true
+}
+
+// Swaps the CSRF token of a request for the one of a session made during it, so the page it shows has the new one.
+func setCSRFToken(req *http.Request, token string) {
+	gContext.Set(req, csrfContextKey{}, token)
+}
+
+// CSRFToken gets the CSRF token to put in the forms of a page
+func CSRFToken(req *http.Request) string {
+	token, _ := gContext.Get(req, csrfContextKey{}).(string)
+	return token
+}
+
+// CSRFProtect checks every POST was sent from one of our own pages before passing it on.
+// It wraps every handler, so anything registered in main is covered apart from resources, which have no forms.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/res/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		token := loadCSRFToken(req, w)
+		setCSRFToken(req, token)
+
+		if req.Method == "POST" {
+			sent := req.FormValue(csrfFieldName)
+			if sent == "" {
+				sent = req.Header.Get(csrfHeaderName)
+			}
+
+			if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				log.Printf("Rejected a request to %s without a valid csrf token from %s", req.URL.Path, GetClientIP(req))
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(GetLocale(req), "error.csrf")))
+				http.Redirect(w, req, req.URL.RequestURI(), http.StatusSeeOther)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// csrfField is the template function that puts the token into a form, {{ csrfField . }}
+func csrfField(data *ViewData) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(data.CSRFToken) + `">`)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Errors returned by the data layer, which handlers turn into something to show the user.
+var (
+	// ErrNotFound is returned when nothing matches what was asked for
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when something being saved clashes with something already stored
+	ErrDuplicate = errors.New("already exists")
+	// ErrConflict is returned when saving something that has been changed by someone else since it was read
+	ErrConflict = errors.New("changed since it was read")
+	// ErrUnavailable is returned when the database can't be reached or doesn't answer in time
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// How long anything waits for the database before giving up
+const dbTimeout = 5 * time.Second
+
+// Gets the context database calls made for a request run under, ending with the request or after dbTimeout.
+func dbContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), dbTimeout)
+}
+
+// Gets the context database calls made outside of any request run under
+func backgroundContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dbTimeout)
+}
+
+// Marks an error as the database being unavailable, keeping what actually went wrong
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// Gets the status code a data error should be answered with
+func dataErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// Gets the message to show the user for a data error
+func dataErrorMessage(locale string, err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return string(T(locale, "error.not-found"))
+	case errors.Is(err, ErrDuplicate):
+		return string(T(locale, "error.duplicate"))
+	case errors.Is(err, ErrConflict):
+		return string(T(locale, "error.conflict"))
+	default:
+		return string(T(locale, "error.unavailable"))
+	}
+}
+
+// Shows a data error as a page of its own, for when there is nothing sensible to redirect to.
+func serveDataError(w http.ResponseWriter, req *http.Request, locale string, err error) {
+	viewData := &ViewData{
+		Viewer: &User{Locale: locale},
+		Data: map[string]interface{}{
+			"message": dataErrorMessage(locale, err),
+		},
+	}
+
+	w.WriteHeader(dataErrorStatus(err))
+	templateErr := templates.ExecuteTemplate(w, "error.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing error template:", templateErr)
+	}
+}
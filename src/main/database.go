@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
@@ -22,12 +26,44 @@ type DBCredentials struct {
 
 var session *mgo.Session
 
+// The database everything kept in Mongo is in
+var mongoDatabase = "smark"
+
+// Checks if anything has been configured to be kept in Mongo
+func needsMongo() bool {
+	return Cfg.Storage.Users == "mongo" || Cfg.Security.AttemptStore == "mongo" || Cfg.Sessions.Store == "mongo"
+}
+
+// errNoMongo is why anything only kept in Mongo is unavailable when running without it
+var errNoMongo = errors.New("not connected to Mongo")
+
+// Runs a call saving something only kept in Mongo, which can't be done without it.
+func mongoOnly(ctx context.Context, call func() error) error {
+	if session == nil {
+		return unavailable(errNoMongo)
+	}
+	return mongoCall(ctx, call)
+}
+
+// Runs a call finding or removing something only kept in Mongo, without it there is nothing to find.
+func mongoFind(ctx context.Context, call func() error) error {
+	if session == nil {
+		return ErrNotFound
+	}
+	return mongoCall(ctx, call)
+}
+
 func dbInit() {
 
 	// Load credentials
 	jsonFile, err := os.Open("db.json")
 	if err != nil {
-		log.Fatal(err)
+		if needsMongo() {
+			log.Fatal(err)
+		}
+
+		// Invites, remember me and the audit log are turned off without it
+		log.Println("[!!] No db.json, running without Mongo:", err)
 		return
 	}
 
@@ -48,62 +84,392 @@ func dbInit() {
 }
 
 func userCollection() *mgo.Collection {
-	return session.DB("smark").C("users")
+	return session.DB(mongoDatabase).C("users")
 }
 
-// GetUserByEmail queries the database and gets a user matching the email.
-func GetUserByEmail(email string) *User {
-	var rUser *User
-	err := userCollection().Find(bson.M{"email": cIQuery(email)}).One(&rUser)
-	if err != nil {
-		return nil
+func attemptCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("attempts")
+}
+
+func sessionCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("sessions")
+}
+
+func rememberCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("remember")
+}
+
+func inviteCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("invites")
+}
+
+func migrationCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("migrations")
+}
+
+func auditCollection() *mgo.Collection {
+	return session.DB(mongoDatabase).C("audit")
+}
+
+// Logs a failed lookup, unless there was simply nothing to find
+func logLookupErr(what string, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("[!!] Failed to get user by %s : %s", what, err)
 	}
+}
+
+// Logs a failure to do something with the database, leaving out things that just weren't there.
+func logDataErr(what string, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("[!!] Failed to %s : %s", what, err)
+	}
+}
 
-	return rUser
+// GetUserByID gets the user with the ID given
+func GetUserByID(ctx context.Context, id string) (*User, error) {
+	user, err := Users.GetByID(ctx, id)
+	logLookupErr("ID", err)
+	return user, err
+}
+
+// GetUserByEmail queries the database and gets a user matching the email.
+func GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := Users.GetByEmail(ctx, email)
+	logLookupErr("email", err)
+	return user, err
 }
 
 // GetUserByName queries the database and gets a user matching the username.
-func GetUserByName(username string) *User {
-	var rUser *User
-	err := userCollection().Find(bson.M{"username": cIQuery(username)}).One(&rUser)
+func GetUserByName(ctx context.Context, username string) (*User, error) {
+	user, err := Users.GetByName(ctx, username)
+	logLookupErr("name", err)
+	return user, err
+}
+
+// GetUserByPreviousName gets a user who changed away from the username within the given time.
+func GetUserByPreviousName(ctx context.Context, username string, within time.Duration) (*User, error) {
+	user, err := Users.GetByPreviousName(ctx, username, within)
+	logLookupErr("previous name", err)
+	return user, err
+}
+
+// GetUserByEmailUsername attemps to get a user by their username or email
+func GetUserByEmailUsername(ctx context.Context, field string) (*User, error) {
+	user, err := Users.GetByEmailOrName(ctx, field)
+	logLookupErr("email or name", err)
+	return user, err
+}
+
+// SetLastSeenDB writes when each user, by ID, was last seen in one go
+func SetLastSeenDB(ctx context.Context, lastSeen map[string]time.Time) error {
+	err := Users.SetLastSeen(ctx, lastSeen)
 	if err != nil {
-		return nil
+		log.Println("[!!] Failed to save last seen times:", err)
 	}
+	return err
+}
 
-	return rUser
+// SetOfflineDB marks a user as offline, last seen at the time given if that is later than what is stored.
+func SetOfflineDB(ctx context.Context, userID string, lastSeen time.Time) error {
+	err := Users.SetOffline(ctx, userID, lastSeen)
+	// They may have been deleted since
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("[!!] Failed to mark user %s offline : %s", userID, err)
+	}
+	return err
 }
 
-// GetUserByEmailUsername attemps to get a user by their username or email
-func GetUserByEmailUsername(field string) *User {
-	var rUser *User
-	err := userCollection().Find(bson.M{"$or": []bson.M{{"username": cIQuery(field)}, {"email": cIQuery(field)}}}).One(&rUser)
+// SetLocaleDB saves the locale of a user on its own
+func SetLocaleDB(ctx context.Context, userID string, locale string) error {
+	err := Users.SetLocale(ctx, userID, locale)
 	if err != nil {
-		return nil
+		log.Printf("[!!] Failed to save locale of user %s : %s", userID, err)
 	}
+	return err
+}
 
-	return rUser
+// SetGlobalTagDB saves the tag shown before a user's name on its own
+func SetGlobalTagDB(ctx context.Context, userID string, tag string) error {
+	err := Users.SetGlobalTag(ctx, userID, tag)
+	if err != nil {
+		log.Printf("[!!] Failed to save tag of user %s : %s", userID, err)
+	}
+	return err
+}
+
+// ClearInviterDB forgets who invited anyone invited by the user with the ID given
+func ClearInviterDB(ctx context.Context, inviterID string) error {
+	err := Users.ClearInviter(ctx, inviterID)
+	logDataErr("forget users invited by "+inviterID, err)
+	return err
 }
 
 // InsertUserDB inserts a user object into the database
-func InsertUserDB(user *User) {
-	err := userCollection().Insert(&user)
+func InsertUserDB(ctx context.Context, user *User) error {
+	err := Users.Insert(ctx, user)
 	if err != nil {
-		return
+		log.Printf("[!!] Failed to create user %s : %s", user.Username, err)
+		return err
 	}
 
 	log.Printf("Created user %s", user.Username)
+	return nil
 }
 
 // UpdateUserDB updates an existing user object into the database
-func UpdateUserDB(user *User) {
-	err := userCollection().Update(bson.M{"email": cIQuery(user.Email)}, &user)
+func UpdateUserDB(ctx context.Context, user *User) error {
+	err := Users.Update(ctx, user)
 	if err != nil {
-		log.Printf("[!!] Failed to update user %s : %e", user.Email, err)
-		return
+		log.Printf("[!!] Failed to update user %s : %s", user.ID, err)
 	}
+	return err
+}
+
+// DeleteUserDB removes a user from the database
+func DeleteUserDB(ctx context.Context, user *User) error {
+	err := Users.Delete(ctx, user)
+	if err != nil {
+		log.Printf("[!!] Failed to delete user %s : %s", user.ID, err)
+	}
+	return err
+}
+
+// GetUsersDueDeletionDB gets every user whose deletion grace period has run out
+func GetUsersDueDeletionDB(ctx context.Context, now time.Time) ([]*User, error) {
+	users, err := Users.DueDeletion(ctx, now)
+	if err != nil {
+		log.Println("[!!] Failed to get users due deletion:", err)
+	}
+	return users, err
+}
+
+// InsertInviteDB inserts an invite into the database
+func InsertInviteDB(ctx context.Context, invite *Invite) error {
+	err := mongoOnly(ctx, func() error {
+		return inviteCollection().Insert(invite)
+	})
+	logDataErr("save invite", err)
+	return err
+}
+
+// GetInviteDB gets an invite by its code
+func GetInviteDB(ctx context.Context, code string) (*Invite, error) {
+	var invite *Invite
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().FindId(code).One(&invite)
+	})
+	if err != nil {
+		logDataErr("get invite", err)
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// GetInvitesDB gets every invite, newest first
+func GetInvitesDB(ctx context.Context) ([]Invite, error) {
+	var invites []Invite
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().Find(nil).Sort("-created").All(&invites)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	logDataErr("get invites", err)
+	return invites, err
+}
+
+// GetUserInvitesDB gets every invite made by the user with the ID given, newest first
+func GetUserInvitesDB(ctx context.Context, userID string) ([]Invite, error) {
+	var invites []Invite
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().Find(bson.M{"createdby": userID}).Sort("-created").All(&invites)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	logDataErr("get invites of "+userID, err)
+	return invites, err
+}
+
+// ClearInviteCreatorDB forgets who made the invites made by the user with the ID given
+func ClearInviteCreatorDB(ctx context.Context, userID string) error {
+	err := mongoFind(ctx, func() error {
+		_, err := inviteCollection().UpdateAll(bson.M{"createdby": userID}, bson.M{"$set": bson.M{"createdby": ""}})
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	logDataErr("forget invites made by "+userID, err)
+	return err
+}
+
+// UseInviteDB takes a use from an invite, giving ErrNotFound if it has none left.
+func UseInviteDB(ctx context.Context, code string) error {
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().Update(
+			bson.M{"_id": code, "remaining": bson.M{"$gt": 0}, "expires": bson.M{"$gt": time.Now()}},
+			bson.M{"$inc": bson.M{"remaining": -1}},
+		)
+	})
+	logDataErr("use invite "+code, err)
+	return err
+}
+
+// ReleaseInviteDB gives a use back to an invite
+func ReleaseInviteDB(ctx context.Context, code string) error {
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().UpdateId(code, bson.M{"$inc": bson.M{"remaining": 1}})
+	})
+	logDataErr("release invite "+code, err)
+	return err
+}
+
+// DeleteInviteDB removes an invite so it can't be used
+func DeleteInviteDB(ctx context.Context, code string) error {
+	err := mongoFind(ctx, func() error {
+		return inviteCollection().RemoveId(code)
+	})
+	logDataErr("delete invite "+code, err)
+	return err
+}
+
+// InsertRememberTokenDB inserts a remember me token into the database
+func InsertRememberTokenDB(ctx context.Context, token *RememberToken) error {
+	err := mongoOnly(ctx, func() error {
+		return rememberCollection().Insert(token)
+	})
+	logDataErr("save remember me token of "+token.UserID, err)
+	return err
+}
+
+// GetRememberTokenDB gets a remember me token by its selector
+func GetRememberTokenDB(ctx context.Context, selector string) (*RememberToken, error) {
+	var token *RememberToken
+	err := mongoFind(ctx, func() error {
+		return rememberCollection().FindId(selector).One(&token)
+	})
+	if err != nil {
+		logDataErr("get remember me token", err)
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// RotateRememberTokenDB marks a remember me token as replaced, giving ErrNotFound if it already was.
+func RotateRememberTokenDB(ctx context.Context, selector string) error {
+	err := mongoFind(ctx, func() error {
+		return rememberCollection().Update(
+			bson.M{"_id": selector, "rotated": time.Time{}},
+			bson.M{"$set": bson.M{"rotated": time.Now()}},
+		)
+	})
+	logDataErr("rotate remember me token", err)
+	return err
+}
+
+// DeleteRememberTokenDB removes a remember me token
+func DeleteRememberTokenDB(ctx context.Context, selector string) error {
+	err := mongoFind(ctx, func() error {
+		return rememberCollection().RemoveId(selector)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	logDataErr("delete remember me token", err)
+	return err
+}
+
+// DeleteUserRememberTokensDB removes every remember me token of a user apart from the one with the selector given
+func DeleteUserRememberTokensDB(ctx context.Context, userID string, exceptSelector string) error {
+	err := mongoFind(ctx, func() error {
+		_, err := rememberCollection().RemoveAll(bson.M{"userid": userID, "_id": bson.M{"$ne": exceptSelector}})
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	logDataErr("delete remember me tokens of "+userID, err)
+	return err
+}
+
+// InsertAuditDB inserts an audit event into the database, without Mongo they are only kept in the log.
+func InsertAuditDB(ctx context.Context, event *AuditEvent) error {
+	if session == nil {
+		return nil
+	}
+
+	err := mongoCall(ctx, func() error {
+		return auditCollection().Insert(event)
+	})
+	logDataErr("save audit event "+event.Event, err)
+	return err
+}
+
+// Matches the audit events of a user, by their ID or by any of their names for events recorded without one.
+func userAuditQuery(user *User) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"userid": user.ID},
+		{"userid": bson.M{"$in": []interface{}{nil, ""}}, "username": bson.M{"$in": cIQueries(user.AllNames())}},
+	}}
+}
+
+// GetAuditEventsDB gets all the audit events recorded against a user, oldest first
+func GetAuditEventsDB(ctx context.Context, user *User) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := mongoFind(ctx, func() error {
+		return auditCollection().Find(userAuditQuery(user)).Sort("time").All(&events)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	logDataErr("get audit events of "+user.ID, err)
+	return events, err
+}
+
+// Matches the audit events of others done to a user, by their ID or by the name in the detail for events recorded without one.
+func targetAuditQuery(user *User) bson.M {
+	details := make([]bson.RegEx, 0, len(user.AllNames()))
+	for _, name := range user.AllNames() {
+		details = append(details, bson.RegEx{Pattern: "^as " + regexp.QuoteMeta(name) + "$", Options: "i"})
+	}
+
+	return bson.M{"$or": []bson.M{
+		{"targetid": user.ID},
+		{"event": bson.M{"$in": []string{AuditImpersonateStart, AuditImpersonateStop}}, "detail": bson.M{"$in": details}},
+	}}
+}
+
+// AnonymiseAuditDB removes anything identifying a user from the audit events recorded against them, and from those done to them by others.
+func AnonymiseAuditDB(ctx context.Context, user *User) error {
+	err := mongoFind(ctx, func() error {
+		_, err := auditCollection().UpdateAll(userAuditQuery(user), bson.M{"$set": bson.M{"userid": "", "username": "", "ip": ""}})
+		if err != nil {
+			return err
+		}
+
+		_, err = auditCollection().UpdateAll(targetAuditQuery(user), bson.M{"$set": bson.M{"targetid": "", "detail": ""}})
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	logDataErr("anonymise audit events of "+user.ID, err)
+	return err
 }
 
 // Makes a query- case insensitive
 func cIQuery(in string) map[string]interface{} {
-	return bson.M{"$regex": bson.RegEx{Pattern: "^" + in + "$", Options: "i"}}
+	return bson.M{"$regex": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(in) + "$", Options: "i"}}
+}
+
+// Makes a list of values case insensitive to match against with $in
+func cIQueries(in []string) []bson.RegEx {
+	queries := make([]bson.RegEx, len(in))
+	for i, value := range in {
+		queries[i] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+	}
+	return queries
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func emailChangeHandle(w http.ResponseWriter, req *http.Request) {
+	user, _ := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	email := req.FormValue("email")
+
+	if !passMatch(user.Password, []byte(req.FormValue("password"))) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.invalid-credentials")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if email == "" || !regexEmail.MatchString(email) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.email-invalid")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	_, err := GetUserByEmail(ctx, email)
+	if err == nil {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.email-used")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+	if !errors.Is(err, ErrNotFound) {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+
+	// A new nonce means any earlier links stop working
+	user.PendingEmail = email
+	user.EmailNonce = generateSessionKey()
+	if !saveAccountOrFail(w, req, user) {
+		return
+	}
+
+	valid := time.Duration(Cfg.VerifyExpiryHours) * time.Hour
+	confirmLink := Cfg.BaseURL + "/settings/email/confirm?token=" + url.QueryEscape(CreateSignedToken(TokenPurposeEmailChange, user.ID, user.EmailNonce, valid))
+	cancelLink := Cfg.BaseURL + "/settings/email/cancel?token=" + url.QueryEscape(CreateSignedToken(TokenPurposeEmailCancel, user.ID, user.EmailNonce, valid))
+
+	if !SendMail(email, string(T(user.Locale, "mail.email-change.subject")), string(T(user.Locale, "mail.email-change.body", user.Username, confirmLink))) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.mail-failed")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+	SendMail(user.Email, string(T(user.Locale, "mail.email-notice.subject")), string(T(user.Locale, "mail.email-notice.body", user.Username, email, cancelLink)))
+
+	Audit(AuditEmailChangeRequested, user.ID, user.Username, GetClientIP(req), email)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "settings.email.sent", email)))
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+}
+
+// Gets the user an email change token belongs to, if it is for their current change.
+// The error is only given when the database couldn't be used.
+func emailChangeTokenUser(ctx context.Context, purpose string, rawToken string) (*User, error) {
+	token, err := ReadSignedToken(purpose, rawToken)
+	if err != nil {
+		log.Printf("Rejected email change token: %s", err)
+		return nil, nil
+	}
+
+	user, err := tokenUser(ctx, token)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.PendingEmail == "" || user.EmailNonce == "" || user.EmailNonce != token.Nonce {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func emailConfirmHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	user, err := emailChangeTokenUser(ctx, TokenPurposeEmailChange, req.FormValue("token"))
+	if err != nil {
+		serveDataError(w, req, locale, err)
+		return
+	}
+	if user == nil {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "verify.invalid")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	// Someone may have taken it while the link was waiting
+	_, err = GetUserByEmail(ctx, user.PendingEmail)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		serveDataError(w, req, locale, err)
+		return
+	}
+	if err == nil {
+		user.PendingEmail = ""
+		user.EmailNonce = ""
+		if !saveAccountOrFail(w, req, user) {
+			return
+		}
+
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "error.email-used")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	oldEmail := user.Email
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+	user.EmailNonce = ""
+	// They've just proven they own it
+	user.Pending = false
+	user.VerifyNonce = ""
+
+	err = SaveAccount(ctx, user)
+	if errors.Is(err, ErrDuplicate) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "error.email-used")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		serveDataError(w, req, locale, err)
+		return
+	}
+
+	Audit(AuditEmailChanged, user.ID, user.Username, GetClientIP(req), oldEmail+" -> "+user.Email)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(locale, "settings.email.changed", user.Email)))
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+}
+
+func emailCancelHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	user, err := emailChangeTokenUser(ctx, TokenPurposeEmailCancel, req.FormValue("token"))
+	if err != nil {
+		serveDataError(w, req, locale, err)
+		return
+	}
+	if user == nil {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "verify.invalid")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	cancelled := user.PendingEmail
+	user.PendingEmail = ""
+	user.EmailNonce = ""
+	if !saveAccountOrFail(w, req, user) {
+		return
+	}
+
+	Audit(AuditEmailChangeCancelled, user.ID, user.Username, GetClientIP(req), cancelled)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(locale, "settings.email.cancelled")))
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// HashBcrypt hashes passwords with bcrypt
+	HashBcrypt = "bcrypt"
+	// HashArgon2id hashes passwords with argon2id
+	HashArgon2id = "argon2id"
+)
+
+// HashPolicy is how new passwords are hashed
+type HashPolicy struct {
+	// Algorithm is either "bcrypt" or "argon2id"
+	Algorithm string `json:"algorithm"`
+
+	BcryptCost int `json:"bcrypt_cost"`
+
+	// Argon2Memory is in KiB
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+	Argon2KeyLen  uint32 `json:"argon2_key_length"`
+}
+
+// Validate checks the policy can hash passwords, a bad one would fail or panic on every signup and login.
+func (policy HashPolicy) Validate() error {
+	if policy.Algorithm == HashBcrypt {
+		if policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return nil
+	}
+
+	switch {
+	case policy.Argon2Time < 1:
+		return errors.New("argon2_time must be at least 1")
+	case policy.Argon2Threads < 1:
+		return errors.New("argon2_threads must be at least 1")
+	case policy.Argon2Memory < 8*uint32(policy.Argon2Threads):
+		return errors.New("argon2_memory must be at least 8 KiB for each thread")
+	case policy.Argon2KeyLen < 16:
+		return errors.New("argon2_key_length must be at least 16")
+	}
+	return nil
+}
+
+// argon2Hash is a decoded argon2id hash and the parameters that produced it
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+var errUnknownHash = errors.New("unknown hash format")
+
+// Decodes a hash stored in the PHC string format, $argon2id$v=19$m=65536,t=3,p=2$salt$key
+func decodeArgon2Hash(hashed []byte) (*argon2Hash, error) {
+	parts := strings.Split(string(hashed), "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, errUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+
+	hash := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+
+	// argon2 panics on no passes or threads, and an empty key would match any password
+	if hash.time == 0 || hash.threads == 0 || len(hash.key) == 0 {
+		return nil, errors.New("malformed argon2 parameters")
+	}
+
+	return hash, nil
+}
+
+// Hashes a password with argon2id using the policy's parameters
+func hashArgon2(password []byte, policy HashPolicy) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey(password, salt, policy.Argon2Time, policy.Argon2Memory, policy.Argon2Threads, policy.Argon2KeyLen)
+
+	return []byte(fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", HashArgon2id, argon2.Version,
+		policy.Argon2Memory, policy.Argon2Time, policy.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Gets which algorithm produced a stored hash
+func hashAlgorithm(hashed []byte) string {
+	if strings.HasPrefix(string(hashed), "$"+HashArgon2id+"$") {
+		return HashArgon2id
+	}
+	return HashBcrypt
+}
+
+func hashSaltPassword(password []byte) []byte {
+	policy := Cfg.Hashing
+
+	var hash []byte
+	var err error
+	if policy.Algorithm == HashArgon2id {
+		hash, err = hashArgon2(password, policy)
+	} else {
+		hash, err = bcrypt.GenerateFromPassword(password, policy.BcryptCost)
+	}
+
+	if err != nil {
+		log.Println("[!!] Error hashing password. ", err)
+		return password
+	}
+
+	return hash
+}
+
+func passMatch(hashed []byte, input []byte) bool {
+	if hashAlgorithm(hashed) == HashArgon2id {
+		hash, err := decodeArgon2Hash(hashed)
+		if err != nil {
+			log.Println("[!!] Error reading hashed password. ", err)
+			return false
+		}
+
+		key := argon2.IDKey(input, hash.salt, hash.time, hash.memory, hash.threads, uint32(len(hash.key)))
+		return subtle.ConstantTimeCompare(key, hash.key) == 1
+	}
+
+	err := bcrypt.CompareHashAndPassword(hashed, input)
+	if err != nil {
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			log.Println("[!!] Error comparing hashed password. ", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// Checks if a stored hash was made with a different algorithm or weaker parameters than the current policy.
+func needsRehash(hashed []byte) bool {
+	policy := Cfg.Hashing
+	algorithm := hashAlgorithm(hashed)
+
+	if algorithm != policy.Algorithm {
+		return true
+	}
+
+	if algorithm == HashArgon2id {
+		hash, err := decodeArgon2Hash(hashed)
+		if err != nil {
+			return true
+		}
+
+		return hash.time < policy.Argon2Time || hash.memory < policy.Argon2Memory ||
+			hash.threads < policy.Argon2Threads || uint32(len(hash.key)) < policy.Argon2KeyLen
+	}
+
+	cost, err := bcrypt.Cost(hashed)
+	return err != nil || cost < policy.BcryptCost
+}
+
+// Upgrades a user's stored hash to the current policy, this has to be done when we know their password.
+func upgradePasswordHash(ctx context.Context, user *User, password []byte) {
+	if !needsRehash(user.Password) {
+		return
+	}
+
+	securePass := hashSaltPassword(password)
+	if string(securePass) == string(password) {
+		return
+	}
+
+	user.Password = securePass
+	// They can still log in with the old hash, so this is tried again next time
+	if SaveAccount(ctx, user) != nil {
+		return
+	}
+
+	log.Printf("Upgraded password hash of %s to %s", user.Username, Cfg.Hashing.Algorithm)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestHashPolicyValidate(t *testing.T) {
+	if err := defaultConfig().Hashing.Validate(); err != nil {
+		t.Errorf("default policy refused: %v", err)
+	}
+
+	for name, change := range map[string]func(*HashPolicy){
+		"bcrypt cost of 0":  func(p *HashPolicy) { p.BcryptCost = 0 },
+		"bcrypt cost of 40": func(p *HashPolicy) { p.BcryptCost = 40 },
+		"no argon2 passes":  func(p *HashPolicy) { p.Algorithm, p.Argon2Time = HashArgon2id, 0 },
+		"no argon2 threads": func(p *HashPolicy) { p.Algorithm, p.Argon2Threads = HashArgon2id, 0 },
+		"no argon2 key":     func(p *HashPolicy) { p.Algorithm, p.Argon2KeyLen = HashArgon2id, 0 },
+		"too little memory": func(p *HashPolicy) { p.Algorithm, p.Argon2Memory = HashArgon2id, 1 },
+	} {
+		policy := defaultConfig().Hashing
+		change(&policy)
+		if policy.Validate() == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long an impersonation lasts before the admin has to start it again
+const impersonationExpiry = time.Hour
+
+// Checks if the user is being impersonated, sending the admin back if so.
+// Used by anything that changes a password or other security settings.
+func blockImpersonation(w http.ResponseWriter, req *http.Request, user *User) bool {
+	if user.ImpersonatedBy == "" {
+		return false
+	}
+
+	CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "impersonate.blocked")))
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+	return true
+}
+
+// Starts an admin viewing the site as another user. Their own session is kept to go back to.
+func impersonateHandle(w http.ResponseWriter, req *http.Request) {
+	admin := getAdmin(w, req)
+	if admin == nil {
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/admin", http.StatusSeeOther)
+		return
+	}
+
+	_, adminKey, _ := GetSessionedUser(req, w)
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	target, err := GetAccount(ctx, req.FormValue("username"), false)
+	if errors.Is(err, ErrNotFound) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(admin.Locale, "error.user-no-exist")))
+		http.Redirect(w, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		serveDataError(w, req, admin.Locale, err)
+		return
+	}
+
+	// They would be able to use the other admin's rights
+	if target.IsAdmin {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(admin.Locale, "impersonate.no-admins")))
+		http.Redirect(w, req, "/admin", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	key := generateSessionKey()
+	err = Sessions.Save(ctx, &Session{
+		Key:            key,
+		UserID:         target.ID,
+		Created:        now,
+		LastActivity:   now,
+		IP:             GetClientIP(req),
+		UserAgent:      req.UserAgent(),
+		ImpersonatedBy: admin.ID,
+		AdminSession:   adminKey,
+		CSRFToken:      generateSessionKey(),
+		Expires:        now.Add(impersonationExpiry),
+	})
+	if err != nil {
+		serveDataError(w, req, admin.Locale, err)
+		return
+	}
+
+	session, _ := cookies.Get(req, "session-id")
+	session.Values["id"] = key
+	cookies.Save(req, w, session)
+
+	AuditOn(AuditImpersonateStart, admin.ID, admin.Username, target, GetClientIP(req))
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(admin.Locale, "impersonate.started", target.Username)))
+	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+}
+
+// Ends an impersonation, putting the admin back in their own session.
+func stopImpersonation(w http.ResponseWriter, req *http.Request, user *User, sessionKey string) {
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	record, err := Sessions.Get(ctx, sessionKey)
+	if err == nil {
+		err = endSession(ctx, record)
+	}
+	// The session is kept so they can try again
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		serveDataError(w, req, GetLocale(req), err)
+		return
+	}
+
+	// Only their ID is kept in the session
+	adminName := user.ImpersonatedBy
+	if admin, err := GetUserByID(ctx, user.ImpersonatedBy); err == nil {
+		adminName = admin.Username
+	}
+
+	AuditOn(AuditImpersonateStop, user.ImpersonatedBy, adminName, user, GetClientIP(req))
+	log.Printf("%s stopped viewing as %s", adminName, user.Username)
+
+	if record != nil {
+		_, err = Sessions.Get(ctx, record.AdminSession)
+	}
+
+	session, _ := cookies.Get(req, "session-id")
+	if record == nil || err != nil {
+		// Their own session ran out in the meantime
+		delete(session.Values, "id")
+		cookies.Save(req, w, session)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	session.Values["id"] = record.AdminSession
+	cookies.Save(req, w, session)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(GetLocale(req), "impersonate.stopped")))
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
+
+func stopImpersonateHandle(w http.ResponseWriter, req *http.Request) {
+	user, sessionKey, err := GetSessionedUser(req, w)
+	if err != "" || req.Method != "POST" || user.ImpersonatedBy == "" {
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	stopImpersonation(w, req, user, sessionKey)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	// SignupOpen lets anyone sign up
+	SignupOpen = "open"
+	// SignupInvite only lets people with an invite code sign up
+	SignupInvite = "invite"
+	// SignupClosed stops anyone signing up
+	SignupClosed = "closed"
+)
+
+// Invite is a code admins hand out to let people sign up when the site is invite only
+type Invite struct {
+	Code string `bson:"_id" json:"code"`
+	// CreatedBy is the ID of the admin who made it
+	CreatedBy string    `bson:"createdby" json:"created_by"`
+	Created   time.Time `bson:"created" json:"created"`
+	// MaxUses is how many people can sign up with it, Remaining is how many still can.
+	MaxUses   int       `bson:"maxuses" json:"max_uses"`
+	Remaining int       `bson:"remaining" json:"remaining"`
+	Expires   time.Time `bson:"expires" json:"expires"`
+	// Email locks the invite to one email address, if set.
+	Email string `bson:"email" json:"email"`
+}
+
+// Usable is if the invite can still be used to sign up
+func (invite Invite) Usable() bool {
+	return invite.Remaining > 0 && time.Now().Before(invite.Expires)
+}
+
+// Generates a new invite code, made to be easy to type out
+func generateInviteCode() string {
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return ""
+	}
+	return base32.StdEncoding.EncodeToString(b)
+}
+
+// CreateInvite makes a new invite code and saves it
+func CreateInvite(ctx context.Context, creator *User, maxUses int, valid time.Duration, email string) (*Invite, error) {
+	invite := &Invite{
+		Code:      generateInviteCode(),
+		CreatedBy: creator.ID,
+		Created:   time.Now(),
+		MaxUses:   maxUses,
+		Remaining: maxUses,
+		Expires:   time.Now().Add(valid),
+		Email:     strings.TrimSpace(email),
+	}
+
+	if err := InsertInviteDB(ctx, invite); err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// ClaimInvite checks an invite can be used by the email and takes one use from it.
+// The message is what to tell them when they can't use it, the error is only for the database failing.
+// If the signup then fails the use should be given back with ReleaseInvite.
+func ClaimInvite(ctx context.Context, locale string, code string, email string) (*Invite, string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return nil, string(T(locale, "signup.invite-required")), nil
+	}
+
+	invite, err := GetInviteDB(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && !invite.Usable()) {
+		return nil, string(T(locale, "signup.invite-invalid")), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if invite.Email != "" && NormalizeKey(invite.Email) != NormalizeKey(email) {
+		return nil, string(T(locale, "signup.invite-wrong-email")), nil
+	}
+
+	// Someone else may have used the last one since
+	err = UseInviteDB(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		return nil, string(T(locale, "signup.invite-invalid")), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return invite, "", nil
+}
+
+// ReleaseInvite gives back a use of an invite
+func ReleaseInvite(ctx context.Context, invite *Invite) error {
+	return ReleaseInviteDB(ctx, invite.Code)
+}
+
+// inviterIDs turns inviters kept by username, from before users had IDs, into the IDs of who has that name.
+type inviterIDs struct {
+	byName map[string]string
+	known  map[string]bool
+}
+
+// Current names are taken over names someone used to have
+func newInviterIDs(users []*User) *inviterIDs {
+	inviters := &inviterIDs{byName: map[string]string{}, known: map[string]bool{}}
+	for _, user := range users {
+		inviters.known[user.ID] = true
+		for _, change := range user.NameHistory {
+			inviters.byName[NormalizeKey(change.Name)] = user.ID
+		}
+	}
+	for _, user := range users {
+		inviters.byName[NormalizeKey(user.Username)] = user.ID
+	}
+	return inviters
+}
+
+// Gets the ID an inviter should be kept as, and if it is different. Names nobody has any more become empty.
+func (inviters *inviterIDs) id(inviter string) (string, bool) {
+	if inviter == "" || inviters.known[inviter] {
+		return inviter, false
+	}
+	return inviters.byName[NormalizeKey(inviter)], true
+}
+
+// Refers to the creators of invites by their ID, or with dryRun only counts the invites that would be changed.
+func migrateInviteCreators(ctx context.Context, inviters *inviterIDs, dryRun bool) (int, error) {
+	// Invites are only kept in Mongo
+	if session == nil {
+		return 0, nil
+	}
+
+	var invites []Invite
+	err := mongoCall(ctx, func() error {
+		return inviteCollection().Find(nil).Select(bson.M{"createdby": 1}).All(&invites)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, invite := range invites {
+		id, changed := inviters.id(invite.CreatedBy)
+		if !changed {
+			continue
+		}
+
+		if !dryRun {
+			err := mongoCall(ctx, func() error {
+				return inviteCollection().UpdateId(invite.Code, bson.M{"$set": bson.M{"createdby": id}})
+			})
+			if err != nil {
+				return migrated, fmt.Errorf("giving invite %s its creator's ID: %w", invite.Code, err)
+			}
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// Refers to inviters by their ID in users and invites kept in Mongo
+func migrateMongoInviters(ctx context.Context, dryRun bool) (int, error) {
+	var users []*User
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(nil).Select(bson.M{"uid": 1, "username": 1, "namehistory": 1, "invitedby": 1}).All(&users)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	inviters := newInviterIDs(users)
+	migrated := 0
+	for _, user := range users {
+		id, changed := inviters.id(user.InvitedBy)
+		if !changed {
+			continue
+		}
+
+		if !dryRun {
+			err := mongoCall(ctx, func() error {
+				return userCollection().Update(bson.M{"uid": user.ID}, bson.M{"$set": bson.M{"invitedby": id}})
+			})
+			if err != nil {
+				return migrated, fmt.Errorf("referring to the inviter of user %s by ID: %w", user.ID, err)
+			}
+		}
+		migrated++
+	}
+
+	invites, err := migrateInviteCreators(ctx, inviters, dryRun)
+	return migrated + invites, err
+}
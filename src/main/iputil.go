@@ -1,71 +1,84 @@
 package main
 
 import (
-	"bytes"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 )
 
-type ipRange struct {
-	start net.IP
-	end   net.IP
-}
+// Proxies whose forwarded headers are believed, read from Cfg.Security.TrustedProxies
+var trustedProxies []*net.IPNet
 
-func inRange(r ipRange, ipAddress net.IP) bool {
-	return bytes.Compare(ipAddress, r.start) >= 0 && bytes.Compare(ipAddress, r.end) < 0
-}
+// Reads the addresses of trusted proxies, each either a single address or a range like 10.0.0.0/8.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q isn't an address", proxy)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
 
-var privateRanges = []ipRange{
-	ipRange{
-		start: net.ParseIP("10.0.0.0"),
-		end:   net.ParseIP("10.255.255.255"),
-	},
-	ipRange{
-		start: net.ParseIP("100.64.0.0"),
-		end:   net.ParseIP("100.127.255.255"),
-	},
-	ipRange{
-		start: net.ParseIP("172.16.0.0"),
-		end:   net.ParseIP("172.31.255.255"),
-	},
-	ipRange{
-		start: net.ParseIP("192.0.0.0"),
-		end:   net.ParseIP("192.0.0.255"),
-	},
-	ipRange{
-		start: net.ParseIP("192.168.0.0"),
-		end:   net.ParseIP("192.168.255.255"),
-	},
-	ipRange{
-		start: net.ParseIP("198.18.0.0"),
-		end:   net.ParseIP("198.19.255.255"),
-	},
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q isn't a range: %w", proxy, err)
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed, nil
 }
 
-func isPrivateSubnet(ipAddress net.IP) bool {
-	if ipCheck := ipAddress.To4(); ipCheck != nil {
-		for _, r := range privateRanges {
-			if inRange(r, ipAddress) {
-				return true
-			}
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
 		}
 	}
 	return false
 }
 
-// GetIP attempts to get an IP of a request
+// GetIP gets the address a request was forwarded for, which is only believed when it came through a trusted proxy.
+// Anyone else could put whatever they like in the headers.
 func GetIP(r *http.Request) string {
-	for _, h := range []string{"X-Forwarded-For", "X-Real-Ip"} {
-		addresses := strings.Split(r.Header.Get(h), ",")
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !isTrustedProxy(net.ParseIP(peer)) {
+		return ""
+	}
+
+	// Each proxy adds who it got the request from to the end, so the client is the last one that isn't a proxy of ours
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addresses := strings.Split(forwarded, ",")
 		for i := len(addresses) - 1; i >= 0; i-- {
-			ip := strings.TrimSpace(addresses[i])
-			realIP := net.ParseIP(ip)
-			if !realIP.IsGlobalUnicast() || isPrivateSubnet(realIP) {
-				continue
+			ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+			if ip == nil {
+				return ""
+			}
+			if !isTrustedProxy(ip) {
+				return ip.String()
 			}
-			return ip
 		}
+		return ""
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); ip != nil {
+		return ip.String()
 	}
 	return ""
 }
+
+// GetClientIP gets the address of a request, falling back to who connected when it isn't forwarded.
+func GetClientIP(r *http.Request) string {
+	ip := GetIP(r)
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	return ip
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+
+	for _, test := range []struct {
+		name      string
+		peer      string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"not forwarded", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"made up by the client", "203.0.113.5:1234", "198.51.100.7", "198.51.100.8", "203.0.113.5"},
+		{"through our proxy", "10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"made up before our proxy", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"through several of ours", "10.0.0.1:1234", "198.51.100.7, 192.168.1.2", "", "198.51.100.7"},
+		{"real ip header", "192.168.4.4:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"garbage", "10.0.0.1:1234", "nonsense", "", "10.0.0.1"},
+	} {
+		req := &http.Request{RemoteAddr: test.peer, Header: http.Header{}}
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-Ip", test.realIP)
+		}
+
+		if ip := GetClientIP(req); ip != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, ip, test.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesRefusesGarbage(t *testing.T) {
+	for _, proxy := range []string{"nonsense", "10.0.0.0/99"} {
+		if _, err := parseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("%q was accepted", proxy)
+		}
+	}
+}
@@ -18,9 +18,10 @@ var Lang *i18n.I18n
 var GeoIP *maxminddb.Reader
 
 // GuestLocaleCache is indexed by their address and the value of their locale. This is to stop looking up everytime.
-var GuestLocaleCache map[string]string
+var GuestLocaleCache = newLocaleCache()
 
-var record struct {
+// geoRecord is what is read out of the ip database
+type geoRecord struct {
 	Country struct {
 		ISOCode string `maxminddb:"iso_code"`
 	} `maxminddb:"country"`
@@ -37,9 +38,6 @@ func initLocale() {
 		log.Println("[!!] Error opening geo ip database:", err)
 	}
 	GeoIP = db
-
-	// declare map
-	GuestLocaleCache = make(map[string]string)
 }
 
 // T translates a string
@@ -56,18 +54,42 @@ func GetLocale(r *http.Request) string {
 		return "US"
 	}
 
-	cachedLocale := GuestLocaleCache[ip.String()]
+	cachedLocale := GuestLocaleCache.Get(ip.String())
 	if cachedLocale != "" {
 		return cachedLocale
 	}
 
+	// Couldn't be opened on startup
+	if GeoIP == nil {
+		return "US"
+	}
+
+	// Each lookup decodes into its own record as many requests look up at once
+	var record geoRecord
 	err := GeoIP.Lookup(ip, &record)
 	if err != nil {
 		log.Println("[!!] Error looking up IP:", ip, err)
-		GuestLocaleCache[ip.String()] = "US"
+		GuestLocaleCache.Set(ip.String(), "US")
 		return "US"
 	}
 
-	GuestLocaleCache[ip.String()] = record.Country.ISOCode
+	GuestLocaleCache.Set(ip.String(), record.Country.ISOCode)
+	return record.Country.ISOCode
+}
+
+// GetCountry gets the country code of an address, or an empty string if it isn't known
+func GetCountry(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil || GeoIP == nil {
+		return ""
+	}
+
+	var record geoRecord
+	err := GeoIP.Lookup(ip, &record)
+	if err != nil {
+		log.Println("[!!] Error looking up IP:", ip, err)
+		return ""
+	}
+
 	return record.Country.ISOCode
 }
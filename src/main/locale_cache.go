@@ -0,0 +1,52 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// How many parts the locale cache is split into, so requests don't all wait on the same lock
+const localeCacheShards = 32
+
+// LocaleCache is a map of addresses to locales that is safe to use from every request at once.
+type LocaleCache struct {
+	shards [localeCacheShards]*localeCacheShard
+}
+
+type localeCacheShard struct {
+	lock    sync.RWMutex
+	locales map[string]string
+}
+
+func newLocaleCache() *LocaleCache {
+	cache := &LocaleCache{}
+	for i := range cache.shards {
+		cache.shards[i] = &localeCacheShard{locales: map[string]string{}}
+	}
+	return cache
+}
+
+// Gets the shard an address is kept in
+func (c *LocaleCache) shard(ip string) *localeCacheShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(ip))
+	return c.shards[hash.Sum32()%localeCacheShards]
+}
+
+// Get gets the locale cached for an address, or an empty string if there isn't one
+func (c *LocaleCache) Get(ip string) string {
+	shard := c.shard(ip)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	return shard.locales[ip]
+}
+
+// Set caches the locale of an address
+func (c *LocaleCache) Set(ip string, locale string) {
+	shard := c.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	shard.locales[ip] = locale
+}
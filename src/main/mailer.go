@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// SMTPMailer sends mail through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends the mail over SMTP
+func (m SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", m.Host, m.Port), auth, m.From, []string{to}, formatMail(m.From, to, subject, body))
+}
+
+// FileMailer writes mail to a local file, or the log if there is no file, instead of sending it.
+type FileMailer struct {
+	Path string
+	From string
+}
+
+// Send appends the mail to the file or log
+func (m FileMailer) Send(to string, subject string, body string) error {
+	mail := formatMail(m.From, to, subject, body)
+
+	if m.Path == "" {
+		log.Printf("Mail:\n%s", mail)
+		return nil
+	}
+
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(mail, []byte("\r\n.\r\n")...))
+	return err
+}
+
+// Formats a plain text mail with its headers
+func formatMail(from string, to string, subject string, body string) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+	}
+
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body)
+}
+
+// Mail is the mailer used to send mail
+var Mail Mailer
+
+func mailerInit() {
+	c := Cfg.Mail
+
+	switch c.Transport {
+	case "smtp":
+		Mail = SMTPMailer{Host: c.Host, Port: c.Port, Username: c.Username, Password: c.Password, From: c.From}
+	case "file":
+		Mail = FileMailer{Path: c.File, From: c.From}
+	default:
+		Mail = FileMailer{From: c.From}
+	}
+
+	log.Printf("Using %s mailer", c.Transport)
+}
+
+// SendMail sends a mail and logs if it fails
+func SendMail(to string, subject string, body string) bool {
+	err := Mail.Send(to, subject, body)
+	if err != nil {
+		log.Printf("[!!] Failed to send mail to %s: %s", to, err)
+		return false
+	}
+
+	return true
+}
@@ -21,12 +21,32 @@ func main() {
 	regexEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
 	// Init modules
+	configInit()
+	siteSettingsInit()
 	sessionsInit()
+	tokensInit()
+	mailerInit()
 	dbInit()
+	userStoreInit()
+
+	// Commands are run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	runMigrations()
+	attemptsInit()
+	sessionStoreInit()
+	rememberInit()
 	initLocale()
+	passwordPolicyInit()
 
 	templates = populateTemplates()
 
+	go deletionReaper()
+	go sessionReaper()
+	go presenceFlusher()
+
 	// Main handle
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		requestedPath := req.URL.Path[1:]
@@ -61,12 +81,31 @@ func main() {
 
 	})
 	http.HandleFunc("/login", loginHandle)
+	http.HandleFunc("/login/2fa", loginTwoFactorHandle)
 	http.HandleFunc("/signup", signupHandle)
 	http.HandleFunc("/logout", logoutHandle)
+	http.HandleFunc("/forgot", forgotHandle)
+	http.HandleFunc("/reset", resetHandle)
+	http.HandleFunc("/verify", verifyHandle)
+	http.HandleFunc("/verify/resend", verifyResendHandle)
+	http.HandleFunc("/settings/password", passwordChangeHandle)
+	http.HandleFunc("/settings/username", usernameChangeHandle)
+	http.HandleFunc("/settings/email", emailChangeHandle)
+	http.HandleFunc("/settings/email/confirm", emailConfirmHandle)
+	http.HandleFunc("/settings/email/cancel", emailCancelHandle)
+	http.HandleFunc("/settings/2fa", twoFactorSetupHandle)
+	http.HandleFunc("/settings/sessions", sessionsHandle)
+	http.HandleFunc("/settings/export", exportHandle)
+	http.HandleFunc("/settings/delete", deleteAccountHandle)
+	http.HandleFunc("/settings/delete/cancel", cancelDeleteAccountHandle)
+	http.HandleFunc("/presence/heartbeat", presenceHeartbeatHandle)
+	http.HandleFunc("/admin", adminHandle)
+	http.HandleFunc("/admin/impersonate", impersonateHandle)
+	http.HandleFunc("/impersonate/stop", stopImpersonateHandle)
 	http.HandleFunc("/profile/", profileLoadHandle)
 	http.HandleFunc("/res/", handleResourceRequest)
 
-	http.ListenAndServe(":8080", gContext.ClearHandler(http.DefaultServeMux))
+	http.ListenAndServe(":8080", gContext.ClearHandler(CSRFProtect(TrackPresence(RequireTwoFactorSetup(http.DefaultServeMux)))))
 }
 
 // Method to handle requests to the resources folder
@@ -97,7 +136,7 @@ func handleResourceRequest(w http.ResponseWriter, req *http.Request) {
 
 // Method to get templates
 func populateTemplates() *template.Template {
-	result := template.New("templates").Funcs(template.FuncMap{"t": T})
+	result := template.New("templates").Funcs(template.FuncMap{"t": T, "csrfField": csrfField, "heartbeatSeconds": func() int { return Cfg.Presence.HeartbeatSeconds }})
 
 	templateFolder, _ := os.Open(templatePath)
 	defer templateFolder.Close()
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Migration is a numbered change to the database. Up has to be safe to run again, and when dryRun is set only counts what it would change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, dryRun bool) (int, error)
+}
+
+// Every migration for users kept in Mongo, a version must never be reused or changed once released.
+var mongoMigrations = []Migration{
+	{Version: 1, Name: "give users IDs", Up: migrateUserIDs},
+	{Version: 2, Name: "add username and email keys", Up: migrateUserKeys},
+	{Version: 3, Name: "create user indexes", Up: ensureUserIndexes},
+	{Version: 4, Name: "fill in online for users without it", Up: migrateUserOnline},
+	{Version: 5, Name: "give users a version", Up: migrateUserVersions},
+	{Version: 6, Name: "refer to inviters by ID", Up: migrateMongoInviters},
+}
+
+const (
+	// How long a lock is held before another instance may take it, in case the one holding it died.
+	migrationLockHold = 10 * time.Minute
+	// How long starting up waits for another instance to finish migrating
+	migrationLockWait = 15 * time.Minute
+)
+
+// MigrationRecord is a migration that has been applied
+type MigrationRecord struct {
+	Version int       `bson:"_id"`
+	Name    string    `bson:"name"`
+	Applied time.Time `bson:"applied"`
+}
+
+// MigrationLog keeps which migrations have been applied, and a lock so only one instance applies them at a time.
+type MigrationLog interface {
+	Applied(ctx context.Context) ([]MigrationRecord, error)
+	Record(ctx context.Context, record MigrationRecord) error
+	// Lock takes the lock for the owner, returning false if someone else holds it. It is let go of after hold if not unlocked.
+	Lock(ctx context.Context, owner string, hold time.Duration) (bool, error)
+	Unlock(ctx context.Context, owner string) error
+}
+
+// memoryMigrationLog keeps migrations in memory, for running without a database.
+type memoryMigrationLog struct {
+	lock    sync.Mutex
+	records map[int]MigrationRecord
+	owner   string
+	expires time.Time
+}
+
+func newMemoryMigrationLog() *memoryMigrationLog {
+	return &memoryMigrationLog{records: map[int]MigrationRecord{}}
+}
+
+func (l *memoryMigrationLog) Applied(ctx context.Context) ([]MigrationRecord, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var records []MigrationRecord
+	for _, record := range l.records {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (l *memoryMigrationLog) Record(ctx context.Context, record MigrationRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.records[record.Version]; ok {
+		return ErrDuplicate
+	}
+	l.records[record.Version] = record
+	return nil
+}
+
+func (l *memoryMigrationLog) Lock(ctx context.Context, owner string, hold time.Duration) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if l.owner != "" && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+
+	l.owner = owner
+	l.expires = now.Add(hold)
+	return true, nil
+}
+
+func (l *memoryMigrationLog) Unlock(ctx context.Context, owner string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.owner == owner {
+		l.owner = ""
+	}
+	return nil
+}
+
+// The lock is kept in the migrations collection alongside the records, which are keyed by version.
+const migrationLockID = "lock"
+
+// mongoMigrationLog keeps migrations in the migrations collection
+type mongoMigrationLog struct{}
+
+func (l *mongoMigrationLog) Applied(ctx context.Context) ([]MigrationRecord, error) {
+	var records []MigrationRecord
+	err := mongoCall(ctx, func() error {
+		return migrationCollection().Find(bson.M{"_id": bson.M{"$ne": migrationLockID}}).All(&records)
+	})
+	return records, err
+}
+
+func (l *mongoMigrationLog) Record(ctx context.Context, record MigrationRecord) error {
+	return mongoCall(ctx, func() error {
+		return migrationCollection().Insert(record)
+	})
+}
+
+func (l *mongoMigrationLog) Lock(ctx context.Context, owner string, hold time.Duration) (bool, error) {
+	now := time.Now()
+	err := mongoCall(ctx, func() error {
+		_, err := migrationCollection().Upsert(
+			bson.M{"_id": migrationLockID, "$or": []bson.M{{"owner": owner}, {"expires": bson.M{"$lt": now}}}},
+			bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(hold)}},
+		)
+		return err
+	})
+
+	// Held by someone else, so the upsert tried to make a second lock
+	if errors.Is(err, ErrDuplicate) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *mongoMigrationLog) Unlock(ctx context.Context, owner string) error {
+	err := mongoCall(ctx, func() error {
+		return migrationCollection().Remove(bson.M{"_id": migrationLockID, "owner": owner})
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// MigrationStatus is a migration along with when it was applied, if it has been.
+type MigrationStatus struct {
+	Migration
+	Applied time.Time
+}
+
+// Gets every migration in order of version, with when each was applied.
+func migrationStatus(ctx context.Context, record MigrationLog, list []Migration) ([]MigrationStatus, error) {
+	records, err := record.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+	for _, r := range records {
+		applied[r.Version] = r.Applied
+	}
+
+	status := make([]MigrationStatus, 0, len(list))
+	for _, migration := range list {
+		status = append(status, MigrationStatus{Migration: migration, Applied: applied[migration.Version]})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+
+	return status, nil
+}
+
+// Applies any migrations that haven't been yet, in order, and returns the versions applied.
+// With dryRun nothing is changed or recorded, what would be is only logged.
+// The lock must be held while this runs unless it is a dry run.
+func migrate(ctx context.Context, record MigrationLog, list []Migration, dryRun bool) ([]int, error) {
+	status, err := migrationStatus(ctx, record, list)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []int
+	for _, migration := range status {
+		if !migration.Applied.IsZero() {
+			continue
+		}
+
+		changed, err := migration.Up(ctx, dryRun)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		if dryRun {
+			log.Printf("Would apply migration %d (%s), changing %d", migration.Version, migration.Name, changed)
+			applied = append(applied, migration.Version)
+			continue
+		}
+
+		err = record.Record(ctx, MigrationRecord{Version: migration.Version, Name: migration.Name, Applied: time.Now()})
+		if err != nil {
+			return applied, fmt.Errorf("recording migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		log.Printf("Applied migration %d (%s), changed %d", migration.Version, migration.Name, changed)
+		applied = append(applied, migration.Version)
+	}
+
+	return applied, nil
+}
+
+// Applies any migrations under the lock, waiting up to the time given for another instance holding it.
+func migrateLocked(ctx context.Context, record MigrationLog, list []Migration, wait time.Duration) ([]int, error) {
+	owner := migrationOwner()
+	deadline := time.Now().Add(wait)
+
+	for {
+		locked, err := record.Lock(ctx, owner, migrationLockHold)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("another instance is still migrating")
+		}
+		log.Println("Waiting for another instance to finish migrating")
+		time.Sleep(time.Second)
+	}
+
+	defer func() {
+		if err := record.Unlock(ctx, owner); err != nil {
+			log.Println("[!!] Failed to let go of the migration lock:", err)
+		}
+	}()
+
+	// Whoever held the lock may have applied some already, which is checked for again now it is ours
+	return migrate(ctx, record, list, false)
+}
+
+// Identifies this instance as the holder of the migration lock
+func migrationOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Gets where migrations are recorded for the store users are kept in, along with the migrations it has.
+// Users kept in memory start out empty each time, so there is nothing to migrate.
+func migrationLog() (MigrationLog, []Migration) {
+	switch store := Users.(type) {
+	case *mongoUserStore:
+		return &mongoMigrationLog{}, mongoMigrations
+	case *sqlUserStore:
+		return newSQLMigrationLog(store.db), sqlMigrations(store.db)
+	default:
+		return newMemoryMigrationLog(), nil
+	}
+}
+
+// Brings the database up to date when starting up. Stops the server if it can't be, rather than run on data it doesn't understand.
+func runMigrations() {
+	record, list := migrationLog()
+
+	_, err := migrateLocked(context.Background(), record, list, migrationLockWait)
+	if err != nil {
+		log.Fatal("Failed to migrate the database: ", err)
+	}
+}
+
+// Sets a field on every user that doesn't have it yet, or with dryRun only counts them.
+func fillMissingUserField(ctx context.Context, field string, value interface{}, dryRun bool) (int, error) {
+	missing := bson.M{field: bson.M{"$exists": false}}
+
+	changed := 0
+	err := mongoCall(ctx, func() error {
+		if dryRun {
+			count, err := userCollection().Find(missing).Count()
+			changed = count
+			return err
+		}
+
+		info, err := userCollection().UpdateAll(missing, bson.M{"$set": bson.M{field: value}})
+		if err == nil {
+			changed = info.Updated
+		}
+		return err
+	})
+	return changed, err
+}
+
+// Users saved before online had a tag of its own may not have it at all, which is the same as them being offline.
+func migrateUserOnline(ctx context.Context, dryRun bool) (int, error) {
+	return fillMissingUserField(ctx, "online", false, dryRun)
+}
+
+// Users are only saved if they are still at the version they were read at, which the ones from before versions aren't at any of.
+func migrateUserVersions(ctx context.Context, dryRun bool) (int, error) {
+	return fillMissingUserField(ctx, "version", 0, dryRun)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The SQL migrations, a version must never be reused or changed once released.
+// Each one makes the tables as they were at the time, so they can be brought up from any of the layouts released.
+func sqlMigrations(db *sql.DB) []Migration {
+	return []Migration{
+		{Version: 1, Name: "create user tables", Up: func(ctx context.Context, dryRun bool) (int, error) {
+			return createSQLUserTables(ctx, db, dryRun)
+		}},
+		{Version: 2, Name: "give users IDs", Up: func(ctx context.Context, dryRun bool) (int, error) {
+			return migrateSQLUserIDs(ctx, db, dryRun)
+		}},
+		{Version: 3, Name: "give users a version", Up: func(ctx context.Context, dryRun bool) (int, error) {
+			return migrateSQLUserVersions(ctx, db, dryRun)
+		}},
+		{Version: 4, Name: "refer to inviters by ID", Up: func(ctx context.Context, dryRun bool) (int, error) {
+			return migrateSQLInviters(ctx, db, dryRun)
+		}},
+	}
+}
+
+// Checks if a table has a column, which also tells if the table is there at all.
+// This is done outside of any transaction, as Postgres gives up on the rest of one after a failed statement.
+func sqlHasColumn(ctx context.Context, db *sql.DB, table string, column string) bool {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s LIMIT 1`, column, table))
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// Counts the rows of a table, none if it hasn't been made yet as happens in a dry run.
+func sqlCount(ctx context.Context, db *sql.DB, table string) (int, error) {
+	if !sqlHasColumn(ctx, db, table, "*") {
+		return 0, nil
+	}
+
+	var count int
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&count)
+	return count, sqlError(err)
+}
+
+// Runs statements in a transaction of their own
+func sqlExecAll(ctx context.Context, db *sql.DB, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return sqlError(err)
+		}
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// The tables users were first kept in, keyed by their email.
+func createSQLUserTables(ctx context.Context, db *sql.DB, dryRun bool) (int, error) {
+	created := 0
+	for _, table := range []string{"users", "user_names"} {
+		if !sqlHasColumn(ctx, db, table, "*") {
+			created++
+		}
+	}
+	if created == 0 || dryRun {
+		return created, nil
+	}
+
+	return created, sqlExecAll(ctx, db, []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			email_key    TEXT PRIMARY KEY,
+			username_key TEXT NOT NULL UNIQUE,
+			delete_after BIGINT NOT NULL DEFAULT 0,
+			data         TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_names (
+			email_key  TEXT NOT NULL,
+			name_key   TEXT NOT NULL,
+			changed_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS user_names_name ON user_names (name_key)`,
+	})
+}
+
+// Tables from before users had IDs are keyed by email, these are made again keyed by ID.
+func migrateSQLUserIDs(ctx context.Context, db *sql.DB, dryRun bool) (int, error) {
+	if sqlHasColumn(ctx, db, "users", "id") {
+		return 0, nil
+	}
+	if dryRun {
+		return sqlCount(ctx, db, "users")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	users, err := scanUsers(tx.QueryContext(ctx, `SELECT data FROM users`))
+	if err != nil {
+		return 0, sqlError(err)
+	}
+
+	for _, statement := range []string{
+		`DROP TABLE user_names`,
+		`DROP TABLE users`,
+		`CREATE TABLE users (
+			id           TEXT PRIMARY KEY,
+			email_key    TEXT NOT NULL UNIQUE,
+			username_key TEXT NOT NULL UNIQUE,
+			delete_after BIGINT NOT NULL DEFAULT 0,
+			data         TEXT NOT NULL
+		)`,
+		`CREATE TABLE user_names (
+			user_id    TEXT NOT NULL,
+			name_key   TEXT NOT NULL,
+			changed_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX user_names_name ON user_names (name_key)`,
+	} {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return 0, sqlError(err)
+		}
+	}
+
+	for _, user := range users {
+		user.ID = newUserID()
+		user.setKeys()
+		data, err := json.Marshal(user)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO users (id, email_key, username_key, delete_after, data) VALUES ($1, $2, $3, $4, $5)`,
+			user.ID, user.EmailKey, user.UsernameKey, deleteAfterColumn(user), string(data))
+		if err != nil {
+			return 0, fmt.Errorf("giving user %s an ID: %w", user.Username, sqlError(err))
+		}
+
+		for _, change := range user.NameHistory {
+			_, err := tx.ExecContext(ctx, `INSERT INTO user_names (user_id, name_key, changed_at) VALUES ($1, $2, $3)`,
+				user.ID, change.Key, change.ChangedAt.Unix())
+			if err != nil {
+				return 0, sqlError(err)
+			}
+		}
+	}
+
+	return len(users), sqlError(tx.Commit())
+}
+
+// Users are only saved if they are still at the version they were read at, which the ones from before versions aren't at any of.
+func migrateSQLUserVersions(ctx context.Context, db *sql.DB, dryRun bool) (int, error) {
+	if sqlHasColumn(ctx, db, "users", "version") {
+		return 0, nil
+	}
+
+	count, err := sqlCount(ctx, db, "users")
+	if err != nil || dryRun {
+		return count, err
+	}
+
+	return count, sqlExecAll(ctx, db, []string{`ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 0`})
+}
+
+// Refers to inviters by their ID in users, along with invites if they are kept in Mongo.
+func migrateSQLInviters(ctx context.Context, db *sql.DB, dryRun bool) (int, error) {
+	// Only in a dry run, where the table would have been made by now
+	if !sqlHasColumn(ctx, db, "users", "*") {
+		return 0, nil
+	}
+
+	users, err := scanUsers(db.QueryContext(ctx, `SELECT data FROM users`))
+	if err != nil {
+		return 0, sqlError(err)
+	}
+
+	inviters := newInviterIDs(users)
+	migrated := 0
+	for _, user := range users {
+		id, changed := inviters.id(user.InvitedBy)
+		if !changed {
+			continue
+		}
+
+		if !dryRun {
+			user.InvitedBy = id
+			data, err := json.Marshal(user)
+			if err != nil {
+				return migrated, err
+			}
+
+			if _, err := db.ExecContext(ctx, `UPDATE users SET data = $1 WHERE id = $2`, string(data), user.ID); err != nil {
+				return migrated, fmt.Errorf("referring to the inviter of user %s by ID: %w", user.ID, sqlError(err))
+			}
+		}
+		migrated++
+	}
+
+	invites, err := migrateInviteCreators(ctx, inviters, dryRun)
+	return migrated + invites, err
+}
+
+// sqlMigrationLog keeps migrations in the migrations table, and the lock in a table of its own with a single row.
+type sqlMigrationLog struct {
+	db *sql.DB
+}
+
+func newSQLMigrationLog(db *sql.DB) *sqlMigrationLog {
+	return &sqlMigrationLog{db: db}
+}
+
+// Makes the tables the log is kept in if they don't exist yet
+func (l *sqlMigrationLog) prepare(ctx context.Context) error {
+	return sqlExecAll(ctx, l.db, []string{
+		`CREATE TABLE IF NOT EXISTS migrations (
+			version INTEGER PRIMARY KEY,
+			name    TEXT NOT NULL,
+			applied BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS migration_lock (
+			id      INTEGER PRIMARY KEY,
+			owner   TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+	})
+}
+
+func (l *sqlMigrationLog) Applied(ctx context.Context) ([]MigrationRecord, error) {
+	// Nothing has been applied to a database without the table
+	if !sqlHasColumn(ctx, l.db, "migrations", "version") {
+		return nil, nil
+	}
+
+	rows, err := l.db.QueryContext(ctx, `SELECT version, name, applied FROM migrations`)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var records []MigrationRecord
+	for rows.Next() {
+		var record MigrationRecord
+		var applied int64
+		if err := rows.Scan(&record.Version, &record.Name, &applied); err != nil {
+			return nil, sqlError(err)
+		}
+		record.Applied = time.Unix(applied, 0)
+		records = append(records, record)
+	}
+
+	return records, sqlError(rows.Err())
+}
+
+func (l *sqlMigrationLog) Record(ctx context.Context, record MigrationRecord) error {
+	if err := l.prepare(ctx); err != nil {
+		return err
+	}
+
+	_, err := l.db.ExecContext(ctx, `INSERT INTO migrations (version, name, applied) VALUES ($1, $2, $3)`,
+		record.Version, record.Name, record.Applied.Unix())
+	return sqlError(err)
+}
+
+func (l *sqlMigrationLog) Lock(ctx context.Context, owner string, hold time.Duration) (bool, error) {
+	if err := l.prepare(ctx); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	result, err := l.db.ExecContext(ctx, `UPDATE migration_lock SET owner = $1, expires = $2 WHERE id = 1 AND (owner = $1 OR expires < $3)`,
+		owner, now.Add(hold).Unix(), now.Unix())
+	if err != nil {
+		return false, sqlError(err)
+	}
+	if taken, err := result.RowsAffected(); err != nil || taken > 0 {
+		return err == nil, sqlError(err)
+	}
+
+	// Nobody has held it yet, or someone else still does
+	_, err = l.db.ExecContext(ctx, `INSERT INTO migration_lock (id, owner, expires) VALUES (1, $1, $2)`, owner, now.Add(hold).Unix())
+	if err = sqlError(err); errors.Is(err, ErrDuplicate) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *sqlMigrationLog) Unlock(ctx context.Context, owner string) error {
+	_, err := l.db.ExecContext(ctx, `DELETE FROM migration_lock WHERE id = 1 AND owner = $1`, owner)
+	return sqlError(err)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Makes migrations that note down each time they are run
+func countingMigrations(ran *[]int, versions ...int) []Migration {
+	var list []Migration
+	for _, version := range versions {
+		version := version
+		list = append(list, Migration{Version: version, Name: "test", Up: func(ctx context.Context, dryRun bool) (int, error) {
+			*ran = append(*ran, version)
+			return 1, nil
+		}})
+	}
+	return list
+}
+
+func TestMigrateAppliesInOrder(t *testing.T) {
+	var ran []int
+	applied, err := migrate(context.Background(), newMemoryMigrationLog(), countingMigrations(&ran, 3, 1, 2), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ran, []int{1, 2, 3}) || !reflect.DeepEqual(applied, []int{1, 2, 3}) {
+		t.Errorf("ran %v and applied %v, want both in order", ran, applied)
+	}
+}
+
+func TestMigrateRunsEachOnce(t *testing.T) {
+	record := newMemoryMigrationLog()
+	var ran []int
+
+	if _, err := migrate(context.Background(), record, countingMigrations(&ran, 1, 2), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new one released since is all that is left
+	applied, err := migrate(context.Background(), record, countingMigrations(&ran, 1, 2, 3), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ran, []int{1, 2, 3}) || !reflect.DeepEqual(applied, []int{3}) {
+		t.Errorf("ran %v and applied %v on the second run", ran, applied)
+	}
+}
+
+func TestMigrateStopsAtFailure(t *testing.T) {
+	record := newMemoryMigrationLog()
+	var ran []int
+	list := countingMigrations(&ran, 1, 3)
+	list = append(list, Migration{Version: 2, Name: "broken", Up: func(ctx context.Context, dryRun bool) (int, error) {
+		return 0, ErrUnavailable
+	}})
+
+	applied, err := migrate(context.Background(), record, list, false)
+	if err == nil {
+		t.Fatal("expected the failed migration to stop the rest")
+	}
+	if !reflect.DeepEqual(applied, []int{1}) || !reflect.DeepEqual(ran, []int{1}) {
+		t.Errorf("ran %v and applied %v, want only the first", ran, applied)
+	}
+}
+
+func TestMigrateDryRunRecordsNothing(t *testing.T) {
+	record := newMemoryMigrationLog()
+	var dryRuns []bool
+	list := []Migration{{Version: 1, Name: "test", Up: func(ctx context.Context, dryRun bool) (int, error) {
+		dryRuns = append(dryRuns, dryRun)
+		return 1, nil
+	}}}
+
+	applied, err := migrate(context.Background(), record, list, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []int{1}) || !reflect.DeepEqual(dryRuns, []bool{true}) {
+		t.Errorf("applied %v with dry runs %v", applied, dryRuns)
+	}
+
+	records, _ := record.Applied(context.Background())
+	if len(records) != 0 {
+		t.Errorf("dry run recorded %v", records)
+	}
+}
+
+func TestMigrationLockRefusesSecondRunner(t *testing.T) {
+	ctx := context.Background()
+	record := newMemoryMigrationLog()
+
+	if locked, _ := record.Lock(ctx, "first", time.Minute); !locked {
+		t.Fatal("first runner didn't get the lock")
+	}
+	if locked, _ := record.Lock(ctx, "second", time.Minute); locked {
+		t.Fatal("second runner got the lock while it was held")
+	}
+
+	var ran []int
+	if _, err := migrateLocked(ctx, record, countingMigrations(&ran, 1), 0); err == nil || len(ran) > 0 {
+		t.Errorf("migrated while another runner held the lock, ran %v", ran)
+	}
+
+	record.Unlock(ctx, "first")
+	if locked, _ := record.Lock(ctx, "second", time.Minute); !locked {
+		t.Error("second runner didn't get the lock once it was let go of")
+	}
+}
+
+func TestMigrationLockExpires(t *testing.T) {
+	ctx := context.Background()
+	record := newMemoryMigrationLog()
+
+	record.Lock(ctx, "first", -time.Second)
+	if locked, _ := record.Lock(ctx, "second", time.Minute); !locked {
+		t.Error("lock held by a runner that died wasn't let go of")
+	}
+}
+
+// Opens a SQLite database of its own for a test
+func openTestSQLite(t *testing.T) *sql.DB {
+	db, err := openSQL("sqlite3", filepath.Join(t.TempDir(), "smark.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	record := newSQLMigrationLog(db)
+
+	if _, err := migrate(ctx, record, sqlMigrations(db), true); err != nil {
+		t.Fatal(err)
+	}
+	if sqlHasColumn(ctx, db, "users", "*") {
+		t.Fatal("dry run made the users table")
+	}
+
+	applied, err := migrateLocked(ctx, record, sqlMigrations(db), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []int{1, 2, 3, 4}) {
+		t.Errorf("applied %v", applied)
+	}
+
+	applied, err = migrateLocked(ctx, record, sqlMigrations(db), 0)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second run applied %v: %v", applied, err)
+	}
+
+	store := &sqlUserStore{db: db}
+	user := &User{Username: "Ellie", Email: "ellie@example.com"}
+	user.ID = newUserID()
+	if err := store.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetByID(ctx, user.ID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLMigrationsUpgradeEmailKeyedUsers(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	list := sqlMigrations(db)
+
+	// The first layout, before users had IDs
+	if _, err := list[0].Up(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*User{
+		{Username: "Ellie", Email: "Ellie@example.com"},
+		{Username: "Sam", Email: "sam@example.com", InvitedBy: "ellie"},
+	} {
+		data, _ := json.Marshal(user)
+		_, err := db.Exec(`INSERT INTO users (email_key, username_key, data) VALUES ($1, $2, $3)`,
+			NormalizeKey(user.Email), NormalizeKey(user.Username), string(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := migrate(ctx, newSQLMigrationLog(db), list, false); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &sqlUserStore{db: db}
+	ellie, err := store.GetByEmail(ctx, "ellie@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ellie.ID == "" || ellie.Version != 0 {
+		t.Errorf("upgraded user has ID %q and version %d", ellie.ID, ellie.Version)
+	}
+
+	sam, err := store.GetByEmail(ctx, "sam@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sam.InvitedBy != ellie.ID {
+		t.Errorf("inviter is %q, want %q", sam.InvitedBy, ellie.ID)
+	}
+}
+
+func TestInviterIDs(t *testing.T) {
+	users := []*User{
+		{ID: "1", Username: "Ellie", NameHistory: []NameChange{{Name: "Sam"}}},
+		{ID: "2", Username: "Sam"},
+	}
+	inviters := newInviterIDs(users)
+
+	for _, test := range []struct {
+		inviter string
+		want    string
+		changed bool
+	}{
+		{"", "", false},
+		{"1", "1", false},
+		{"ELLIE", "1", true},
+		// Whoever has the name now, not who had it before
+		{"sam", "2", true},
+		{"nobody", "", true},
+	} {
+		id, changed := inviters.id(test.inviter)
+		if id != test.want || changed != test.changed {
+			t.Errorf("inviter %q gave %q, %v, want %q, %v", test.inviter, id, changed, test.want, test.changed)
+		}
+	}
+}
+
+func TestSQLMigrationLockRefusesSecondRunner(t *testing.T) {
+	ctx := context.Background()
+	record := newSQLMigrationLog(openTestSQLite(t))
+
+	if locked, err := record.Lock(ctx, "first", time.Minute); !locked || err != nil {
+		t.Fatalf("first runner didn't get the lock: %v", err)
+	}
+	if locked, err := record.Lock(ctx, "second", time.Minute); locked || err != nil {
+		t.Fatalf("second runner got the lock while it was held: %v", err)
+	}
+
+	record.Unlock(ctx, "first")
+	if locked, err := record.Lock(ctx, "second", time.Minute); !locked || err != nil {
+		t.Errorf("second runner didn't get the lock once it was let go of: %v", err)
+	}
+}
+
+func TestKeyConflicts(t *testing.T) {
+	users := []keyedUser{
+		{Username: "Ellie", Email: "a@example.com"},
+		{Username: "ellie", Email: "b@example.com"},
+		{Username: "Sam", Email: "A@example.com"},
+	}
+
+	conflicts := keyConflicts(users)
+	want := []KeyConflict{
+		{Key: "username_key", Value: "ellie", Names: []string{"Ellie", "ellie"}},
+		{Key: "email_key", Value: "a@example.com", Names: []string{"a@example.com", "A@example.com"}},
+	}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got %v, want %v", conflicts, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy contains the rules a new password has to follow
+type PasswordPolicy struct {
+	MinLength int `json:"min_length"`
+	MaxLength int `json:"max_length"`
+
+	RequireUpper  bool `json:"require_upper"`
+	RequireLower  bool `json:"require_lower"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+
+	// RejectIdentity stops a password being their username or email
+	RejectIdentity bool `json:"reject_identity"`
+
+	// BreachedFile is a list of SHA-1 hashes of known breached passwords, one per line as downloaded
+	// from Pwned Passwords (HASH or HASH:COUNT). It's kept bucketed by the first 5 characters of the hash.
+	BreachedFile string `json:"breached_file"`
+}
+
+// The most bytes of a password bcrypt will hash
+const bcryptMaxBytes = 72
+
+// Length of the hash prefix breached passwords are bucketed by
+const breachedPrefixLength = 5
+
+// breachedHashes are the known breached password hashes, bucketed by prefix then holding the rest of the hash
+var breachedHashes map[string]map[string]struct{}
+
+func passwordPolicyInit() {
+	breachedHashes = make(map[string]map[string]struct{})
+
+	path := Cfg.Password.BreachedFile
+	if path == "" {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("[!!] Failed to open breached password list:", err)
+		return
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, ":"); i != -1 {
+			line = line[:i]
+		}
+		if len(line) != sha1.Size*2 {
+			continue
+		}
+
+		line = strings.ToUpper(line)
+		prefix, suffix := line[:breachedPrefixLength], line[breachedPrefixLength:]
+		if breachedHashes[prefix] == nil {
+			breachedHashes[prefix] = make(map[string]struct{})
+		}
+		breachedHashes[prefix][suffix] = struct{}{}
+		count++
+	}
+
+	if err = scanner.Err(); err != nil {
+		log.Println("[!!] Failed to read breached password list:", err)
+	}
+
+	log.Printf("Loaded %d breached password hashes", count)
+}
+
+// IsBreachedPassword checks if a password is in the breached password list
+func IsBreachedPassword(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	bucket, ok := breachedHashes[hash[:breachedPrefixLength]]
+	if !ok {
+		return false
+	}
+
+	_, ok = bucket[hash[breachedPrefixLength:]]
+	return ok
+}
+
+// Check checks a password against the policy, returning a translated message for the first rule it breaks.
+func (policy PasswordPolicy) Check(locale string, password string, username string, email string) string {
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		return string(T(locale, "error.password-too-short", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		return string(T(locale, "error.password-too-long", policy.MaxLength))
+	}
+	// bcrypt counts bytes rather than characters, which can be several bytes each
+	if Cfg.Hashing.Algorithm == HashBcrypt && len(password) > bcryptMaxBytes {
+		return string(T(locale, "error.password-too-long-bytes"))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if policy.RequireUpper && !upper {
+		return string(T(locale, "error.password-needs-upper"))
+	}
+	if policy.RequireLower && !lower {
+		return string(T(locale, "error.password-needs-lower"))
+	}
+	if policy.RequireDigit && !digit {
+		return string(T(locale, "error.password-needs-digit"))
+	}
+	if policy.RequireSymbol && !symbol {
+		return string(T(locale, "error.password-needs-symbol"))
+	}
+
+	if policy.RejectIdentity {
+		localPart := email
+		if i := strings.LastIndex(email, "@"); i != -1 {
+			localPart = email[:i]
+		}
+
+		for _, identity := range []string{username, email, localPart} {
+			if identity != "" && strings.EqualFold(password, identity) {
+				return string(T(locale, "error.password-identity"))
+			}
+		}
+	}
+
+	if IsBreachedPassword(password) {
+		return string(T(locale, "error.password-breached"))
+	}
+
+	return ""
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	gContext "github.com/gorilla/context"
+)
+
+const (
+	// PresenceOnline is someone who has done something recently
+	PresenceOnline = "online"
+	// PresenceAway is someone who has a page open but hasn't done anything for a while
+	PresenceAway = "away"
+	// PresenceOffline is someone who hasn't been seen for longer than that
+	PresenceOffline = "offline"
+)
+
+type presenceContextKey struct{}
+
+// PresenceTracker keeps track of when users were last active.
+// Activity is kept in memory and written to the database in batches, so every request isn't a write.
+type PresenceTracker struct {
+	lock sync.Mutex
+	// seen is the last activity of users this node has seen, by their ID
+	seen map[string]time.Time
+	// pending is activity not yet written to the database
+	pending map[string]time.Time
+}
+
+// Presence tracks the activity of users
+var Presence = &PresenceTracker{seen: map[string]time.Time{}, pending: map[string]time.Time{}}
+
+// Touch records a user as active right now
+func (p *PresenceTracker) Touch(userID string) {
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.seen[userID] = now
+	p.pending[userID] = now
+}
+
+// LastActive gets when a user was last active, from this node if it has seen them since the last write.
+func (p *PresenceTracker) LastActive(user *User) time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if seen, ok := p.seen[user.ID]; ok && seen.After(user.LastSeen) {
+		return seen
+	}
+	return user.LastSeen
+}
+
+// Status gets whether a user is online, away or offline
+func (p *PresenceTracker) Status(user *User) string {
+	since := time.Since(p.LastActive(user))
+
+	switch {
+	case since < time.Duration(Cfg.Presence.AwayMinutes)*time.Minute:
+		return PresenceOnline
+	case since < time.Duration(Cfg.Presence.OfflineMinutes)*time.Minute:
+		return PresenceAway
+	default:
+		return PresenceOffline
+	}
+}
+
+// Apply fills in a user's presence from their latest activity
+func (p *PresenceTracker) Apply(user *User) {
+	user.LastSeen = p.LastActive(user)
+	user.Presence = p.Status(user)
+	user.Online = user.Presence != PresenceOffline
+}
+
+// Writes any pending activity to the database, and forgets activity too old to matter.
+func (p *PresenceTracker) flush() {
+	p.lock.Lock()
+	batch := p.pending
+	p.pending = map[string]time.Time{}
+
+	forget := time.Now().Add(-time.Duration(Cfg.Presence.OfflineMinutes) * time.Minute)
+	for userID, seen := range p.seen {
+		if seen.Before(forget) {
+			delete(p.seen, userID)
+		}
+	}
+	p.lock.Unlock()
+
+	if len(batch) > 0 {
+		ctx, cancel := backgroundContext()
+		defer cancel()
+		SetLastSeenDB(ctx, batch)
+	}
+}
+
+// Writes activity to the database every so often, this runs for as long as the server does.
+func presenceFlusher() {
+	for {
+		time.Sleep(time.Duration(Cfg.Presence.FlushSeconds) * time.Second)
+		Presence.flush()
+	}
+}
+
+// Marks the request as made by a user, so their activity is recorded once it has been handled
+func markPresence(req *http.Request, userID string) {
+	gContext.Set(req, presenceContextKey{}, userID)
+}
+
+// TrackPresence records activity for every request made by someone logged in.
+func TrackPresence(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req)
+
+		if userID, ok := gContext.Get(req, presenceContextKey{}).(string); ok && userID != "" {
+			Presence.Touch(userID)
+		}
+	})
+}
+
+// Pages call this while they are open and being looked at, so people reading a page still show as online.
+func presenceHeartbeatHandle(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, _, err := GetSessionedUser(req, w)
+	if err != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
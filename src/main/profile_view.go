@@ -1,10 +1,11 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
-	"time"
 )
 
 // ProfileView contains the data needed when viewing another profile
@@ -20,7 +21,12 @@ func profileLoadHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user.LastSeen = time.Now()
+	// Unverified accounts can't look around until they confirm their email
+	if user.Pending {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "verify.required")))
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
 
 	requestedProfile := req.URL.Path[len("/profile/"):]
 
@@ -32,14 +38,32 @@ func profileLoadHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	targetProfile := GetAccount(requestedProfile, false)
-	if targetProfile == nil {
-		http.Redirect(w, req, "/404", http.StatusSeeOther)
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	targetProfile, lookupErr := GetAccount(ctx, requestedProfile, false)
+	if errors.Is(lookupErr, ErrNotFound) {
+		// They may have changed their name since
+		var renamed *User
+		renamed, lookupErr = GetUserByPreviousName(ctx, requestedProfile, nameReservation())
+		if lookupErr == nil {
+			http.Redirect(w, req, "/profile/"+url.PathEscape(renamed.Username), http.StatusSeeOther)
+			return
+		}
+
+		if errors.Is(lookupErr, ErrNotFound) {
+			http.Redirect(w, req, "/404", http.StatusSeeOther)
+			return
+		}
+	}
+	if lookupErr != nil {
+		serveDataError(w, req, user.Locale, lookupErr)
 		return
 	}
 
 	viewData := &ViewData{
-		Viewer: user,
+		Viewer:    user,
+		CSRFToken: CSRFToken(req),
 		ProfileView: ProfileView{
 			Owner: targetProfile,
 		},
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+const rememberCookie = "remember-me"
+
+// How long after a token is rotated it is quietly refused rather than treated as stolen,
+// as a browser can send a few requests at once with the same cookie.
+const rememberReuseGrace = 30 * time.Second
+
+// RememberToken keeps a browser logged in after its session has ended.
+// The cookie holds the selector, to find the token, and the validator, which is only stored hashed.
+type RememberToken struct {
+	Selector      string    `bson:"_id"`
+	ValidatorHash string    `bson:"validator"`
+	UserID        string    `bson:"userid"`
+	Expires       time.Time `bson:"expires"`
+
+	// Rotated is when it was swapped for a new token, using it after this means it has been stolen.
+	Rotated time.Time `bson:"rotated"`
+}
+
+func rememberInit() {
+	if session == nil {
+		return
+	}
+
+	// Tokens delete themselves once expired
+	err := rememberCollection().EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		log.Println("[!!] Failed to create remember me index:", err)
+	}
+}
+
+// Issues a new remember me token to the browser and ties it to their session, so ending the session elsewhere ends the token too.
+// They are only logged in for as long as their session if this fails.
+func rememberUser(ctx context.Context, u *User, sessionKey string, req *http.Request, w http.ResponseWriter) {
+	validator := generateSessionKey()
+	token := &RememberToken{
+		Selector:      generateSessionKey(),
+		ValidatorHash: hashToken(validator),
+		UserID:        u.ID,
+		Expires:       time.Now().AddDate(0, 0, Cfg.Sessions.RememberDays),
+	}
+
+	if token.Selector == "" || validator == "" {
+		return
+	}
+
+	if err := InsertRememberTokenDB(ctx, token); err != nil {
+		return
+	}
+
+	record, err := Sessions.Get(ctx, sessionKey)
+	if err == nil {
+		record.Remember = token.Selector
+		err = Sessions.Save(ctx, record)
+	}
+	// The token has to go with the session, so it isn't handed out without one
+	if err != nil {
+		log.Println("[!!] Failed to tie remember me token to session:", err)
+		DeleteRememberTokenDB(ctx, token.Selector)
+		return
+	}
+
+	cookie, _ := cookies.Get(req, rememberCookie)
+	cookie.Values["token"] = token.Selector + ":" + validator
+	cookie.Options.MaxAge = Cfg.Sessions.RememberDays * 24 * 60 * 60
+	err = cookie.Save(req, w)
+	if err != nil {
+		log.Println("[!!] Failed to save remember me cookie:", err)
+	}
+}
+
+// Removes the remember me token of a browser, if it has one
+func forgetBrowser(ctx context.Context, req *http.Request, w http.ResponseWriter) {
+	cookie, err := cookies.Get(req, rememberCookie)
+	if err != nil {
+		return
+	}
+
+	value, _ := cookie.Values["token"].(string)
+	if value == "" {
+		return
+	}
+
+	// The cookie still goes if this fails, and the token expires by itself
+	selector := strings.SplitN(value, ":", 2)[0]
+	DeleteRememberTokenDB(ctx, selector)
+
+	clearRememberCookie(req, w)
+}
+
+// Expires the remember me cookie without touching the token it holds
+func clearRememberCookie(req *http.Request, w http.ResponseWriter) {
+	cookie, _ := cookies.Get(req, rememberCookie)
+	cookie.Options.MaxAge = -1
+	cookie.Save(req, w)
+}
+
+// Logs a browser back in from its remember me token, swapping it for a new one.
+// Returns their user and new session key, or an error message if the token was stolen.
+func resumeRememberedSession(req *http.Request, w http.ResponseWriter) (*User, string, string) {
+	cookie, err := cookies.Get(req, rememberCookie)
+	if err != nil {
+		return nil, "", ""
+	}
+
+	value, _ := cookie.Values["token"].(string)
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", ""
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	token, err := GetRememberTokenDB(ctx, parts[0])
+	// Kept for when the database is back
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, "", dataErrorMessage(GetLocale(req), err)
+	}
+	if err != nil || time.Now().After(token.Expires) ||
+		subtle.ConstantTimeCompare([]byte(token.ValidatorHash), []byte(hashToken(parts[1]))) != 1 {
+		clearRememberCookie(req, w)
+		return nil, "", ""
+	}
+
+	if !token.Rotated.IsZero() {
+		if time.Since(token.Rotated) < rememberReuseGrace {
+			return nil, "", ""
+		}
+
+		// Whoever has the newer token got it by using this one, so one of them isn't the user
+		Audit(AuditRememberTheft, token.UserID, "", GetClientIP(req), "")
+		clearRememberCookie(req, w)
+		if err := endUserSessions(ctx, &User{ID: token.UserID}, ""); err != nil {
+			log.Println("[!!] Failed to end sessions after a remember me token was reused:", err)
+			return nil, "", dataErrorMessage(GetLocale(req), err)
+		}
+
+		return nil, "", string(T(GetLocale(req), "login.remember-reused"))
+	}
+
+	// Looked up before the token is used up, so it still works once the database is back
+	user, err := GetUserByID(ctx, token.UserID)
+	if errors.Is(err, ErrNotFound) {
+		forgetBrowser(ctx, req, w)
+		return nil, "", ""
+	}
+	if err != nil {
+		return nil, "", dataErrorMessage(GetLocale(req), err)
+	}
+
+	// Someone else has just used it
+	err = RotateRememberTokenDB(ctx, token.Selector)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", ""
+	}
+	if err != nil {
+		return nil, "", dataErrorMessage(GetLocale(req), err)
+	}
+
+	sessionKey, err := createCookie(ctx, user, req, w)
+	if err != nil {
+		return nil, "", dataErrorMessage(GetLocale(req), err)
+	}
+	rememberUser(ctx, user, sessionKey, req, w)
+
+	log.Printf("%s was logged back in from a remember me token", user.Username)
+
+	if user.Locale == "" {
+		user.Locale = GetLocale(req)
+	}
+
+	return user, sessionKey, ""
+}
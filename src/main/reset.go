@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long before another reset link can be sent to the same email, or asked for from the same address
+const resetCooldown = time.Minute
+
+// Counts a reset being asked for against the email it goes to and the address asking, so nobody's inbox can be flooded.
+// Returns false if either asked within the cooldown.
+func reserveReset(ctx context.Context, req *http.Request, email string) (bool, error) {
+	previous := map[string]LoginAttempts{}
+	release := func() {
+		for key, record := range previous {
+			if err := Attempts.Release(ctx, key, record); err != nil {
+				log.Printf("[!!] Failed to give back reset request for %s: %s", key, err)
+			}
+		}
+	}
+
+	allowed := true
+	for _, key := range []string{"reset:email:" + NormalizeKey(email), "reset:" + ipAttemptKey(req)} {
+		record, err := Attempts.Reserve(ctx, key)
+		if err != nil {
+			release()
+			return false, err
+		}
+		previous[key] = record
+
+		if record.Failures > 0 && time.Since(record.LastFailure) < resetCooldown {
+			allowed = false
+		}
+	}
+
+	// Turned away without sending anything, so it doesn't start the wait again
+	if !allowed {
+		release()
+	}
+	return allowed, nil
+}
+
+// Hashes a token so the raw token is never stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Gets the user a reset link was sent to, if the token is still valid.
+// The error is only given when the database couldn't be used.
+func resetTokenUser(ctx context.Context, email string, token string) (*User, error) {
+	if email == "" || token == "" {
+		return nil, nil
+	}
+
+	user, err := GetUserByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ResetHash == "" || time.Now().After(user.ResetExpires) {
+		return nil, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(user.ResetHash), []byte(hashToken(token))) != 1 {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func forgotHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+
+	if req.Method == "POST" {
+		email := req.FormValue("email")
+
+		ctx, cancel := dbContext(req)
+		defer cancel()
+
+		// Checked whether or not anyone has the email, so it can't be used to find out
+		allowed, err := reserveReset(ctx, req, email)
+		if err != nil {
+			serveDataError(w, req, locale, err)
+			return
+		}
+		if !allowed {
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "verify.resend-wait")))
+			http.Redirect(w, req, "/forgot", http.StatusSeeOther)
+			return
+		}
+
+		user, err := GetUserByEmail(ctx, email)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			serveDataError(w, req, locale, err)
+			return
+		}
+
+		if user != nil {
+			token := generateSessionKey()
+			user.ResetHash = hashToken(token)
+			user.ResetExpires = time.Now().Add(time.Duration(Cfg.ResetExpiryMinutes) * time.Minute)
+			if !saveAccountOrFail(w, req, user) {
+				return
+			}
+
+			link := Cfg.BaseURL + "/reset?email=" + url.QueryEscape(user.Email) + "&token=" + url.QueryEscape(token)
+			SendMail(user.Email, string(T(locale, "mail.reset.subject")), string(T(locale, "mail.reset.body", user.Username, link, Cfg.ResetExpiryMinutes)))
+
+			log.Printf("Sent password reset to %s", user.Username)
+		}
+
+		// Say the same thing either way so this can't be used to find out who has an account
+		CreateFlashCookie(req, w, FlashTypeInfo, string(T(locale, "reset.sent")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, _, _ := GetSessionedUser(req, w)
+	viewData := &ViewData{Viewer: user}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "forgot.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing forgot template:", templateErr)
+	}
+}
+
+func resetHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+	email := req.FormValue("email")
+	token := req.FormValue("token")
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	user, err := resetTokenUser(ctx, email, token)
+	if err != nil {
+		serveDataError(w, req, locale, err)
+		return
+	}
+	if user == nil {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "reset.invalid")))
+		http.Redirect(w, req, "/forgot", http.StatusSeeOther)
+		return
+	}
+
+	if req.Method == "POST" {
+		password := req.FormValue("password")
+
+		if policyErr := Cfg.Password.Check(locale, password, user.Username, user.Email); policyErr != "" {
+			CreateFlashCookie(req, w, FlashTypeErr, policyErr)
+			http.Redirect(w, req, "/reset?email="+url.QueryEscape(email)+"&token="+url.QueryEscape(token), http.StatusSeeOther)
+			return
+		}
+
+		securePass := hashSaltPassword([]byte(password))
+		if string(securePass) == password {
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "error.cannot-hash")))
+			http.Redirect(w, req, "/reset?email="+url.QueryEscape(email)+"&token="+url.QueryEscape(token), http.StatusSeeOther)
+			return
+		}
+
+		// Single use
+		user.Password = securePass
+		user.ResetHash = ""
+		user.ResetExpires = time.Time{}
+		if !saveAccountOrFail(w, req, user) {
+			return
+		}
+
+		// Anyone holding their old password is kicked out
+		if err := endUserSessions(ctx, user, ""); err != nil {
+			serveDataError(w, req, locale, err)
+			return
+		}
+		SetOfflineDB(ctx, user.ID, time.Now())
+
+		log.Printf("Reset password of %s", user.Username)
+
+		CreateFlashCookie(req, w, FlashTypeInfo, string(T(locale, "reset.done")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	viewer, _, _ := GetSessionedUser(req, w)
+	viewData := &ViewData{
+		Viewer: viewer,
+		Data: map[string]interface{}{
+			"email": email,
+			"token": token,
+		},
+	}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "reset.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing reset template:", templateErr)
+	}
+}
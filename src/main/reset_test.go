@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestResetCooldown(t *testing.T) {
+	ctx := context.Background()
+	previous := Attempts
+	defer func() { Attempts = previous }()
+	Attempts = &memoryAttemptCounter{records: map[string]LoginAttempts{}}
+
+	from := func(addr string) *http.Request {
+		return &http.Request{RemoteAddr: addr + ":1234", Header: http.Header{}}
+	}
+
+	if allowed, _ := reserveReset(ctx, from("203.0.113.1"), "ellie@example.com"); !allowed {
+		t.Fatal("first reset was refused")
+	}
+	// However it is typed and wherever it is asked for from
+	if allowed, _ := reserveReset(ctx, from("203.0.113.2"), "ELLIE@example.com"); allowed {
+		t.Error("second reset to the same email was allowed")
+	}
+	if allowed, _ := reserveReset(ctx, from("203.0.113.1"), "sam@example.com"); allowed {
+		t.Error("second reset from the same address was allowed")
+	}
+	if allowed, _ := reserveReset(ctx, from("203.0.113.3"), "sam@example.com"); !allowed {
+		t.Error("reset to someone else from somewhere else was refused")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// How long between saving a session's activity, so not every request is a write
+const sessionTouchInterval = time.Minute
+
+// How often expired sessions are looked for
+const sessionReapInterval = time.Minute
+
+// Session is a logged in session, held against the key in their cookie
+type Session struct {
+	Key    string `bson:"_id"`
+	UserID string `bson:"userid"`
+
+	Created      time.Time `bson:"created"`
+	LastActivity time.Time `bson:"lastactivity"`
+	IP           string    `bson:"ip"`
+	UserAgent    string    `bson:"useragent"`
+
+	// Remember is the selector of the remember me token issued with this session
+	Remember string `bson:"remember"`
+	// CSRFToken has to be sent back with every form posted in this session
+	CSRFToken string `bson:"csrftoken"`
+
+	// ImpersonatedBy is the ID of the admin viewing the site as this user, AdminSession is their own session to go back to.
+	ImpersonatedBy string `bson:"impersonatedby"`
+	AdminSession   string `bson:"adminsession"`
+
+	// Expires is when the session is deleted if it isn't used again before then
+	Expires time.Time `bson:"expires"`
+}
+
+// SessionStore keeps the sessions of everyone logged in.
+// Anything not found gives ErrNotFound and any failure to reach the store ErrUnavailable.
+type SessionStore interface {
+	// Get gets a session by its key, giving ErrNotFound if there isn't one or it has expired
+	Get(ctx context.Context, key string) (*Session, error)
+	// Save creates or replaces a session
+	Save(ctx context.Context, session *Session) error
+	// Touch saves a session's last activity, expiry, IP and user agent, giving ErrNotFound if it has since ended
+	Touch(ctx context.Context, session *Session) error
+	// Delete ends a session
+	Delete(ctx context.Context, key string) error
+	// UserSessions gets all of the sessions held by the user with the ID given
+	UserSessions(ctx context.Context, userID string) ([]*Session, error)
+	// DeleteUser ends every session held by a user apart from the one with the key given
+	DeleteUser(ctx context.Context, userID string, exceptKey string) error
+	// RemoveExpired deletes every expired session, returning what was deleted
+	RemoveExpired(ctx context.Context) ([]*Session, error)
+}
+
+// Sessions is the store used for logged in sessions
+var Sessions SessionStore
+
+func sessionStoreInit() {
+	switch Cfg.Sessions.Store {
+	case "mongo":
+		Sessions = newMongoSessionStore()
+	default:
+		Sessions = &memorySessionStore{sessions: map[string]*Session{}}
+	}
+}
+
+// Works out when a session used at the time given expires, either from being left or from being too old.
+func sessionExpires(session *Session, used time.Time) time.Time {
+	idle := used.Add(time.Duration(Cfg.Sessions.IdleHours) * time.Hour)
+	maxAge := session.Created.AddDate(0, 0, Cfg.Sessions.MaxAgeDays)
+	if session.ImpersonatedBy != "" {
+		maxAge = session.Created.Add(impersonationExpiry)
+	}
+
+	if maxAge.Before(idle) {
+		return maxAge
+	}
+	return idle
+}
+
+// Removes expired sessions and marks anyone left without a session as offline, this runs for as long as the server does.
+func sessionReaper() {
+	for {
+		reapSessions()
+		time.Sleep(sessionReapInterval)
+	}
+}
+
+func reapSessions() {
+	ctx, cancel := backgroundContext()
+	defer cancel()
+
+	expired, err := Sessions.RemoveExpired(ctx)
+	if err != nil {
+		log.Println("[!!] Failed to remove expired sessions:", err)
+		return
+	}
+
+	offline := map[string]time.Time{}
+	for _, session := range expired {
+		// An admin looking around as them isn't them being around
+		if session.ImpersonatedBy != "" {
+			continue
+		}
+		if session.LastActivity.After(offline[session.UserID]) {
+			offline[session.UserID] = session.LastActivity
+		}
+	}
+
+	for userID, lastActivity := range offline {
+		remaining, err := Sessions.UserSessions(ctx, userID)
+		if err != nil || hasOwnSession(remaining) {
+			continue
+		}
+
+		SetOfflineDB(ctx, userID, lastActivity)
+	}
+}
+
+// Checks if any of a user's sessions are their own rather than an admin's viewing the site as them
+func hasOwnSession(sessions []*Session) bool {
+	for _, session := range sessions {
+		if session.ImpersonatedBy == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// memorySessionStore keeps sessions in memory, so they are lost on a restart.
+type memorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, key string) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Expired sessions are left for the reaper to remove
+	session, ok := s.sessions[key]
+	if !ok || time.Now().After(session.Expires) {
+		return nil, ErrNotFound
+	}
+
+	// Copied so callers can't change it without saving
+	copied := *session
+	return &copied, nil
+}
+
+func (s *memorySessionStore) Save(ctx context.Context, session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	copied := *session
+	s.sessions[session.Key] = &copied
+	return nil
+}
+
+func (s *memorySessionStore) Touch(ctx context.Context, session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, ok := s.sessions[session.Key]
+	if !ok || time.Now().After(stored.Expires) {
+		return ErrNotFound
+	}
+
+	stored.LastActivity = session.LastActivity
+	stored.Expires = session.Expires
+	stored.IP = session.IP
+	stored.UserAgent = session.UserAgent
+	return nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, key)
+	return nil
+}
+
+func (s *memorySessionStore) UserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var found []*Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && !now.After(session.Expires) {
+			copied := *session
+			found = append(found, &copied)
+		}
+	}
+
+	return found, nil
+}
+
+func (s *memorySessionStore) DeleteUser(ctx context.Context, userID string, exceptKey string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, session := range s.sessions {
+		if session.UserID == userID && key != exceptKey {
+			delete(s.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) RemoveExpired(ctx context.Context) ([]*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var removed []*Session
+	for key, session := range s.sessions {
+		if now.After(session.Expires) {
+			removed = append(removed, session)
+			delete(s.sessions, key)
+		}
+	}
+
+	return removed, nil
+}
+
+// mongoSessionStore keeps sessions in the database so they survive restarts and are shared between nodes.
+type mongoSessionStore struct{}
+
+func newMongoSessionStore() *mongoSessionStore {
+	// Sessions delete themselves once expired, left a while so the reaper can mark their users offline first
+	err := sessionCollection().EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Hour})
+	if err != nil {
+		log.Println("[!!] Failed to create session expiry index:", err)
+	}
+
+	err = sessionCollection().EnsureIndexKey("userid")
+	if err != nil {
+		log.Println("[!!] Failed to create session user index:", err)
+	}
+
+	return &mongoSessionStore{}
+}
+
+func (s *mongoSessionStore) Get(ctx context.Context, key string) (*Session, error) {
+	var session *Session
+	err := mongoCall(ctx, func() error {
+		return sessionCollection().FindId(key).One(&session)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The TTL monitor only runs every so often, so check for ourselves
+	if time.Now().After(session.Expires) {
+		return nil, ErrNotFound
+	}
+
+	return session, nil
+}
+
+func (s *mongoSessionStore) Save(ctx context.Context, session *Session) error {
+	return mongoCall(ctx, func() error {
+		_, err := sessionCollection().UpsertId(session.Key, session)
+		return err
+	})
+}
+
+func (s *mongoSessionStore) Touch(ctx context.Context, session *Session) error {
+	return mongoCall(ctx, func() error {
+		// Only updated rather than upserted, so a session ended meanwhile isn't brought back
+		return sessionCollection().Update(
+			bson.M{"_id": session.Key, "expires": bson.M{"$gt": time.Now()}},
+			bson.M{"$set": bson.M{
+				"lastactivity": session.LastActivity,
+				"expires":      session.Expires,
+				"ip":           session.IP,
+				"useragent":    session.UserAgent,
+			}},
+		)
+	})
+}
+
+func (s *mongoSessionStore) Delete(ctx context.Context, key string) error {
+	err := mongoCall(ctx, func() error {
+		return sessionCollection().RemoveId(key)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *mongoSessionStore) UserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	var found []*Session
+	err := mongoCall(ctx, func() error {
+		return sessionCollection().Find(bson.M{
+			"userid":  userID,
+			"expires": bson.M{"$gt": time.Now()},
+		}).All(&found)
+	})
+	return found, err
+}
+
+func (s *mongoSessionStore) DeleteUser(ctx context.Context, userID string, exceptKey string) error {
+	return mongoCall(ctx, func() error {
+		_, err := sessionCollection().RemoveAll(bson.M{
+			"userid": userID,
+			"_id":    bson.M{"$ne": exceptKey},
+		})
+		return err
+	})
+}
+
+func (s *mongoSessionStore) RemoveExpired(ctx context.Context) ([]*Session, error) {
+	var expired []*Session
+	err := mongoCall(ctx, func() error {
+		return sessionCollection().Find(bson.M{"expires": bson.M{"$lte": time.Now()}}).All(&expired)
+	})
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(expired))
+	for i, session := range expired {
+		keys[i] = session.Key
+	}
+
+	err = mongoCall(ctx, func() error {
+		_, err := sessionCollection().RemoveAll(bson.M{"_id": bson.M{"$in": keys}})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
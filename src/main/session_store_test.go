@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReaperIgnoresImpersonation(t *testing.T) {
+	ctx := context.Background()
+	previousUsers, previousSessions := Users, Sessions
+	defer func() { Users, Sessions = previousUsers, previousSessions }()
+	Users = newMemoryUserStore()
+	Sessions = &memorySessionStore{sessions: map[string]*Session{}}
+
+	user := insertTestUser(t, Users, "Ellie", "ellie@example.com")
+	seen := time.Now().Add(-time.Hour).Truncate(time.Second)
+	Users.SetLastSeen(ctx, map[string]time.Time{user.ID: seen})
+
+	// An admin was looking around as them after they left, and their own session is still going
+	now := time.Now()
+	Sessions.Save(ctx, &Session{Key: "admin", UserID: user.ID, ImpersonatedBy: "admin-id", LastActivity: now.Add(-time.Minute), Expires: now.Add(-time.Second)})
+	Sessions.Save(ctx, &Session{Key: "own", UserID: user.ID, LastActivity: seen, Expires: now.Add(time.Hour)})
+	reapSessions()
+
+	found, _ := Users.GetByID(ctx, user.ID)
+	if !found.Online || !found.LastSeen.Equal(seen) {
+		t.Fatalf("got online %v and last seen %v, want online at %v", found.Online, found.LastSeen, seen)
+	}
+
+	// Once their own runs out they are offline as of when they were last around, not the admin
+	Sessions.Save(ctx, &Session{Key: "admin", UserID: user.ID, ImpersonatedBy: "admin-id", LastActivity: now, Expires: now.Add(time.Hour)})
+	Sessions.Save(ctx, &Session{Key: "own", UserID: user.ID, LastActivity: seen, Expires: now.Add(-time.Second)})
+	reapSessions()
+
+	found, _ = Users.GetByID(ctx, user.ID)
+	if found.Online || !found.LastSeen.Equal(seen) {
+		t.Errorf("got online %v and last seen %v, want offline at %v", found.Online, found.LastSeen, seen)
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
 
+	gContext "github.com/gorilla/context"
 	"github.com/gorilla/sessions"
 )
 
@@ -32,6 +33,8 @@ type ViewData struct {
 	FlashData map[string]string
 	// Data is a map of data that is applicable to the loaded page.
 	Data map[string]interface{}
+	// CSRFToken is put into every form on the page
+	CSRFToken string
 
 	// ProfileView is the sub-struct used when vieiwng another's profile
 	ProfileView
@@ -77,17 +80,17 @@ func (data ViewData) GetFlashKey(key string) string {
 // Cookies is where the cookies are stored.
 var cookies *sessions.CookieStore
 
-// SessionData is a map of all users with a valid cookie indexed by their session key
-var SessionData = map[string]*User{}
-
 func sessionsInit() {
-	// Load up hash for passwords
-	key, err := ioutil.ReadFile("sess_key.txt")
-	if err != nil {
-		log.Fatal(err)
-		return
+	// Load up the keys cookies are signed and encrypted with
+	cookies = sessions.NewCookieStore(loadCookieKeys()...)
+
+	// Signatures have to be accepted for as long as the longest lived cookie, remember me can outlast the rest
+	signatureAge := Cfg.Cookies.MaxAgeDays
+	if Cfg.Sessions.RememberDays > signatureAge {
+		signatureAge = Cfg.Sessions.RememberDays
 	}
-	cookies = sessions.NewCookieStore(key)
+	cookies.MaxAge(signatureAge * 24 * 60 * 60)
+	cookies.Options = cookieOptions()
 
 	gob.Register(FlashCookie{})
 }
@@ -101,11 +104,41 @@ func loginHandle(w http.ResponseWriter, req *http.Request) {
 		username := req.FormValue("username")
 		password := req.FormValue("password")
 
+		ctx, cancel := dbContext(req)
+		defer cancel()
+
 		// get from db
-		u := GetAccount(username, true)
+		u, lookupErr := GetAccount(ctx, username, true)
+		if lookupErr != nil && !errors.Is(lookupErr, ErrNotFound) {
+			serveDataError(w, req, GetLocale(req), lookupErr)
+			return
+		}
+
+		// failures are counted against the account whether they used its name or email
+		accountID, accountName := "", username
+		if u != nil {
+			accountID, accountName = u.ID, u.Username
+		}
+
+		// slow down anyone guessing
+		attempt, throttleErr, attemptsErr := BeginLoginAttempt(ctx, req, GetLocale(req), accountID, accountName)
+		if attemptsErr != nil {
+			serveDataError(w, req, GetLocale(req), attemptsErr)
+			return
+		}
+		if throttleErr != "" {
+			CreateFlashCookie(req, w, FlashTypeErr, throttleErr)
+			if username != "" {
+				CreateFlashCookie(req, w, FlashTypeDataUsername, username)
+			}
+
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+			return
+		}
 
 		// tell them to go away
 		if u == nil {
+			attempt.Fail("no such user")
 			CreateFlashCookie(req, w, FlashTypeErr, string(T(GetLocale(req), "error.user-no-exist")))
 			// Cache their credentials
 			if username != "" {
@@ -116,14 +149,35 @@ func loginHandle(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		// check credentials
-		if (u.Username == username || u.Email == username) && passMatch(u.Password, []byte(password)) {
-			createCookie(u, req, w)
+		// check credentials, the name or email was already matched however it was typed
+		if passMatch(u.Password, []byte(password)) {
+			// Bring old hashes up to the current policy while we have their password
+			upgradePasswordHash(ctx, u, []byte(password))
+
+			remember := req.FormValue("remember") == "on"
+
+			// They still need to enter their code
+			if u.TOTPEnabled {
+				attempt.Release(ctx)
+				beginTwoFactorLogin(u, remember, req, w)
+				return
+			}
+
+			attempt.Succeed(ctx, u)
+			sessionKey, err := createCookie(ctx, u, req, w)
+			if err != nil {
+				serveDataError(w, req, GetLocale(req), err)
+				return
+			}
+			if remember {
+				rememberUser(ctx, u, sessionKey, req, w)
+			}
 			http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
 			return
 		}
 
 		// go away
+		attempt.Fail("wrong password")
 		CreateFlashCookie(req, w, FlashTypeErr, string(T(GetLocale(req), "error.invalid-credentials")))
 
 		if username != "" {
@@ -157,8 +211,46 @@ func signupHandle(w http.ResponseWriter, req *http.Request) {
 		username := req.FormValue("username")
 		password := req.FormValue("password")
 
-		// TODO get their locale from browser
-		u, err := createUser(GetLocale(req), email, username, password)
+		ctx, cancel := dbContext(req)
+		defer cancel()
+
+		var invite *Invite
+		var err string
+
+		switch Site().SignupMode {
+		case SignupClosed:
+			err = string(T(GetLocale(req), "signup.closed"))
+		case SignupInvite:
+			var inviteErr error
+			invite, err, inviteErr = ClaimInvite(ctx, GetLocale(req), req.FormValue("invite"), email)
+			if inviteErr != nil {
+				serveDataError(w, req, GetLocale(req), inviteErr)
+				return
+			}
+		}
+
+		var u *User
+		if err == "" {
+			invitedBy := ""
+			if invite != nil {
+				invitedBy = invite.CreatedBy
+			}
+
+			// TODO get their locale from browser
+			var dataErr error
+			u, err, dataErr = createUser(ctx, GetLocale(req), email, username, password, invitedBy)
+			if (err != "" || dataErr != nil) && invite != nil {
+				if releaseErr := ReleaseInvite(ctx, invite); releaseErr != nil {
+					log.Println("[!!] Failed to give back a use of invite", invite.Code, ":", releaseErr)
+				}
+			}
+
+			if dataErr != nil {
+				serveDataError(w, req, GetLocale(req), dataErr)
+				return
+			}
+		}
+
 		if err != "" {
 			CreateFlashCookie(req, w, FlashTypeErr, string(err))
 			// Cache credentials
@@ -174,15 +266,32 @@ func signupHandle(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		// create session + redirect
-		createCookie(u, req, w)
+		// Log them straight in. Their account is already made, so if the session can't be saved they are shown why and can log in once the database is back
+		if _, dataErr := createCookie(ctx, u, req, w); dataErr != nil {
+			serveDataError(w, req, GetLocale(req), dataErr)
+			return
+		}
+
+		// Account stays pending until they click the link
+		if SendVerification(ctx, u, GetLocale(req)) {
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(GetLocale(req), "verify.sent", u.Email)))
+		} else {
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(GetLocale(req), "error.mail-failed")))
+		}
+
 		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
 		return
 	}
 
 	// Get their session and create an instance of view data
 	user, _, _ := GetSessionedUser(req, w)
-	viewData := &ViewData{Viewer: user}
+	viewData := &ViewData{
+		Viewer: user,
+		Data: map[string]interface{}{
+			"mode":   Site().SignupMode,
+			"invite": req.FormValue("invite"),
+		},
+	}
 	// log.Printf("signup locale %s", user.Locale)
 
 	// Get their flash data from previous sessions
@@ -197,21 +306,53 @@ func signupHandle(w http.ResponseWriter, req *http.Request) {
 }
 
 func logoutHandle(w http.ResponseWriter, req *http.Request) {
-	user, _, err := GetSessionedUser(req, w)
+	// Only from the logout button, so other sites can't log them out
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	user, sessionKey, err := GetSessionedUser(req, w)
 	if err != "" {
 		CreateFlashCookie(req, w, FlashTypeErr, err)
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 		return
 	}
 
+	// Admins go back to their own account rather than logging the user out
+	if user.ImpersonatedBy != "" {
+		stopImpersonation(w, req, user, sessionKey)
+		return
+	}
+
 	// Clean them up
 	deleteCookie(user, req, w)
 	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "login.logged-out")))
 	http.Redirect(w, req, "/login", http.StatusSeeOther)
 }
 
+type sessionedUserContextKey struct{}
+
+// sessionedUser is who a request was found to be from, kept so they are only looked up once a request.
+type sessionedUser struct {
+	user       *User
+	sessionKey string
+	err        string
+}
+
 // GetSessionedUser gets user data, their session id and if an error occurs, that too
 func GetSessionedUser(req *http.Request, w http.ResponseWriter) (*User, string, string) {
+	// Looking them up again could use their remember me token a second time
+	if found, ok := gContext.Get(req, sessionedUserContextKey{}).(sessionedUser); ok {
+		return found.user, found.sessionKey, found.err
+	}
+
+	user, sessionKey, err := loadSessionedUser(req, w)
+	gContext.Set(req, sessionedUserContextKey{}, sessionedUser{user: user, sessionKey: sessionKey, err: err})
+	return user, sessionKey, err
+}
+
+func loadSessionedUser(req *http.Request, w http.ResponseWriter) (*User, string, string) {
 	session, err := cookies.Get(req, "session-id")
 	user := &User{Username: ""}
 
@@ -223,38 +364,135 @@ func GetSessionedUser(req *http.Request, w http.ResponseWriter) (*User, string,
 	// Get their session key id thing
 	sessionKeyRaw := session.Values["id"]
 	if sessionKeyRaw == nil {
-		user.Locale = GetLocale(req)
-		return user, "", string(T(user.Locale, "login.login-prompt"))
+		return resumeSession(req, w, "login.login-prompt")
 	}
 	sessionKey := sessionKeyRaw.(string)
 
-	user, ok := SessionData[sessionKey]
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	record, sessionErr := Sessions.Get(ctx, sessionKey)
+
+	// Their session has run out, or been ended somewhere else
+	if errors.Is(sessionErr, ErrNotFound) {
+		delete(session.Values, "id")
+		cookies.Save(req, w, session)
+
+		return resumeSession(req, w, "login.session-expired")
+	}
+	if sessionErr != nil {
+		user.Locale = GetLocale(req)
+		return user, "", dataErrorMessage(user.Locale, sessionErr)
+	}
 
-	// If they aren't logged in
-	if !ok {
+	user, lookupErr := GetUserByID(ctx, record.UserID)
+	// Their account has gone since they logged in
+	if errors.Is(lookupErr, ErrNotFound) {
+		endSession(ctx, record)
 		user = &User{Username: "", Locale: GetLocale(req)}
 		return user, "", string(T(user.Locale, "login.login-prompt"))
 	}
+	// Their session is kept for when it is back
+	if lookupErr != nil {
+		user = &User{Username: "", Locale: GetLocale(req)}
+		return user, "", dataErrorMessage(user.Locale, lookupErr)
+	}
+
+	// Ended by logging out or being revoked while this request was on its way
+	if errors.Is(touchSession(ctx, record, req), ErrNotFound) {
+		delete(session.Values, "id")
+		cookies.Save(req, w, session)
+
+		return resumeSession(req, w, "login.session-expired")
+	}
+
+	// An admin looking around as them isn't them being around
+	user.ImpersonatedBy = record.ImpersonatedBy
+	if user.ImpersonatedBy == "" {
+		markPresence(req, user.ID)
+	}
+	Presence.Apply(user)
 
 	if user.Locale == "" {
 		user.Locale = GetLocale(req)
+		// Kept from now on so they see the same language wherever they log in from, unless it is an admin's.
+		if user.ImpersonatedBy == "" {
+			SetLocaleDB(ctx, user.ID, user.Locale)
+		}
 	}
 
 	return user, sessionKey, ""
 }
 
-func GetOnlineUser(user *User) *User {
+// Logs them back in if they asked to be remembered, otherwise gives the reason they aren't logged in.
+func resumeSession(req *http.Request, w http.ResponseWriter, reason string) (*User, string, string) {
+	user, sessionKey, err := resumeRememberedSession(req, w)
+	if user != nil {
+		markPresence(req, user.ID)
+		Presence.Apply(user)
+		return user, sessionKey, ""
+	}
 
-	// TODO Find a more efficient way to do this
-	for _, u := range SessionData {
-		if u.Username == user.Username && u.LastSeen.After(time.Now().Add(-(5 * time.Minute))) {
-			return u
-		}
+	user = &User{Username: "", Locale: GetLocale(req)}
+	if err == "" {
+		err = string(T(user.Locale, reason))
 	}
 
+	return user, "", err
+}
+
+// Marks a session as just used, keeping it alive for longer. Gives ErrNotFound if it was ended since it was looked up.
+func touchSession(ctx context.Context, record *Session, req *http.Request) error {
+	now := time.Now()
+	if now.Sub(record.LastActivity) < sessionTouchInterval {
+		return nil
+	}
+
+	record.LastActivity = now
+	record.Expires = sessionExpires(record, now)
+	record.IP = GetClientIP(req)
+	record.UserAgent = req.UserAgent()
+
+	err := Sessions.Touch(ctx, record)
+	if errors.Is(err, ErrNotFound) {
+		return err
+	}
+	// It is only kept alive for less long if this fails
+	if err != nil {
+		log.Println("[!!] Failed to save session activity:", err)
+	}
 	return nil
 }
 
+// Ends a single session along with its remember me token, which would otherwise log the browser straight back in.
+func endSession(ctx context.Context, record *Session) error {
+	if record.Remember != "" {
+		if err := DeleteRememberTokenDB(ctx, record.Remember); err != nil {
+			return err
+		}
+	}
+	return Sessions.Delete(ctx, record.Key)
+}
+
+// Ends every session held by a user apart from the one with the key given, logging them out everywhere else.
+// Their remember me tokens go too, apart from the one belonging to the session kept.
+func endUserSessions(ctx context.Context, user *User, exceptKey string) error {
+	exceptSelector := ""
+	if exceptKey != "" {
+		record, err := Sessions.Get(ctx, exceptKey)
+		if err == nil {
+			exceptSelector = record.Remember
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	if err := DeleteUserRememberTokensDB(ctx, user.ID, exceptSelector); err != nil {
+		return err
+	}
+	return Sessions.DeleteUser(ctx, user.ID, exceptKey)
+}
+
 // Session assignment
 
 // Generates a random session key from 32 bytes then encoding to Base64
@@ -266,25 +504,50 @@ func generateSessionKey() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-// Creates a cookie based on user data and sets to a response writer
-func createCookie(u *User, req *http.Request, w http.ResponseWriter) {
+// Creates a cookie based on user data and sets to a response writer, returning the new session key.
+// They aren't logged in if the session can't be saved.
+func createCookie(ctx context.Context, u *User, req *http.Request, w http.ResponseWriter) (string, error) {
 	session, err := cookies.Get(req, "session-id")
 	if err != nil {
 		log.Printf("[!!] Failed to create get cookie info from Cookies for %s", u.Username)
 	}
 
+	now := time.Now()
 	u.Online = true
-	u.LastSeen = time.Now()
-	u.GlobalTag = "[OG]"
+	u.LastSeen = now
+
+	// Only when they were last seen is saved here, so they are still let in if it fails
+	SetLastSeenDB(ctx, map[string]time.Time{u.ID: now})
+
+	if u.GlobalTag != "[OG]" {
+		u.GlobalTag = "[OG]"
+		SetGlobalTagDB(ctx, u.ID, u.GlobalTag)
+	}
 
 	// make new key
 	newKey := generateSessionKey()
+	// Map session key to user
+	record := &Session{
+		Key:          newKey,
+		UserID:       u.ID,
+		Created:      now,
+		LastActivity: now,
+		IP:           GetClientIP(req),
+		UserAgent:    req.UserAgent(),
+		CSRFToken:    generateSessionKey(),
+	}
+	record.Expires = sessionExpires(record, now)
+	if err := Sessions.Save(ctx, record); err != nil {
+		return "", err
+	}
+	setCSRFToken(req, record.CSRFToken)
+
 	// Mark client with key
 	session.Values["id"] = newKey
 	cookies.Save(req, w, session)
-	// Map session key to user
-	SessionData[newKey] = u
-	GuestLocaleCache[GetIP(req)] = u.Locale
+	GuestLocaleCache.Set(GetIP(req), u.Locale)
+
+	return newKey, nil
 }
 
 // Deletes a cookie by a user
@@ -292,13 +555,19 @@ func deleteCookie(u *User, req *http.Request, w http.ResponseWriter) {
 	// Can't get data via GetSessionedUser as we need to get Session and expire it.
 	session, err := cookies.Get(req, "session-id")
 
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	// Logging out means forgetting them too
+	forgetBrowser(ctx, req, w)
+
 	u.Online = false
 	u.LastSeen = time.Now()
 
 	if err != nil {
-		SaveAccount(u)
+		SetOfflineDB(ctx, u.ID, u.LastSeen)
 		log.Printf("[!!] Failed to delete get cookie info from Cookies for %s", u.Username)
-		// TODO try and get session id from looking SessionData
+		// TODO try and get session id from looking through the session store
 
 		cookie, err := req.Cookie("session-id")
 		if err == nil {
@@ -316,10 +585,12 @@ func deleteCookie(u *User, req *http.Request, w http.ResponseWriter) {
 	}
 	sessionKey := sessionKeyRaw.(string)
 
-	// Remove from session data
-	delete(SessionData, sessionKey)
+	// Remove from session store, the cookie still goes if this fails
+	if err := Sessions.Delete(ctx, sessionKey); err != nil {
+		log.Println("[!!] Failed to delete session:", err)
+	}
 	// Push to database
-	SaveAccount(u)
+	SetOfflineDB(ctx, u.ID, u.LastSeen)
 
 	// Expire cookie
 	session.Options.MaxAge = -1
@@ -348,8 +619,10 @@ func CreateFlashCookie(req *http.Request, w http.ResponseWriter, flashType strin
 	}
 }
 
-// LoadFlashCookies loads in any created flash cookies and appends them to an instance of ViewData
+// LoadFlashCookies loads in any created flash cookies and appends them to an instance of ViewData, along with the page's CSRF token.
 func LoadFlashCookies(req *http.Request, w http.ResponseWriter, viewData *ViewData) *ViewData {
+	viewData.CSRFToken = CSRFToken(req)
+
 	session, _ := cookies.Get(req, "flash-data")
 	flashCookies := session.Flashes()
 	err := session.Save(req, w)
@@ -376,8 +649,9 @@ func CheckAccess(w http.ResponseWriter, req *http.Request, reqPage string) (*Use
 	var user *User
 	user, _, err := GetSessionedUser(req, w)
 
-	// If they're not logged in (i.e in SessionData) and they're not already trying to login, tell them to go away.
+	// If they're not logged in (i.e in the session store) and they're not already trying to login, tell them to go away.
 	if err != "" && !(reqPage == "login" || reqPage == "signup" || reqPage == "404") {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 		return user, errors.New(err)
 	}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gets the requesting user for a settings action, otherwise sends them to login.
+func getSettingsUser(w http.ResponseWriter, req *http.Request) (*User, string) {
+	user, sessionKey, err := GetSessionedUser(req, w)
+	if err != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return nil, ""
+	}
+
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return nil, ""
+	}
+
+	if blockImpersonation(w, req, user) {
+		return nil, ""
+	}
+
+	return user, sessionKey
+}
+
+func passwordChangeHandle(w http.ResponseWriter, req *http.Request) {
+	user, sessionKey := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	current := req.FormValue("current")
+	password := req.FormValue("password")
+
+	if !passMatch(user.Password, []byte(current)) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.invalid-credentials")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if policyErr := Cfg.Password.Check(user.Locale, password, user.Username, user.Email); policyErr != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, policyErr)
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	securePass := hashSaltPassword([]byte(password))
+	if string(securePass) == password {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.cannot-hash")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	user.Password = securePass
+	if !saveAccountOrFail(w, req, user) {
+		return
+	}
+
+	// Anywhere else they were logged in has to login with the new password
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	if err := endUserSessions(ctx, user, sessionKey); err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+
+	log.Printf("%s changed their password", user.Username)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "settings.password.changed")))
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+}
+
+func usernameChangeHandle(w http.ResponseWriter, req *http.Request) {
+	user, _ := getSettingsUser(w, req)
+	if user == nil {
+		return
+	}
+
+	username := strings.TrimSpace(req.FormValue("username"))
+
+	nextChange := user.NameChanged.AddDate(0, 0, Cfg.UsernameCooldownDays)
+	if time.Now().Before(nextChange) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "settings.username.cooldown", nextChange.Format("2006-01-02"))))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if username == "" {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.username-invalid")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if username == user.Username {
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	taken, err := usernameTaken(ctx, username, user)
+	if err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+
+	if taken {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.username-used")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	oldName := user.Username
+
+	// Drop the new name from their history in case they are taking an old one back
+	key := NormalizeKey(username)
+	history := []NameChange{{Name: oldName, Key: NormalizeKey(oldName), ChangedAt: now}}
+	for _, change := range user.NameHistory {
+		if change.Key != key {
+			history = append(history, change)
+		}
+	}
+
+	user.NameHistory = history
+	user.Username = username
+	user.NameChanged = now
+
+	// Someone may have taken it since it was checked
+	err = SaveAccount(ctx, user)
+	if errors.Is(err, ErrDuplicate) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.username-used")))
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		serveDataError(w, req, user.Locale, err)
+		return
+	}
+
+	log.Printf("%s changed their username to %s", oldName, username)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "settings.username.changed", username)))
+	http.Redirect(w, req, "/settings", http.StatusSeeOther)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// Where the site settings are kept
+var siteSettingsPath = "settings.json"
+
+// SiteSettings are the settings admins can change while the site is running
+type SiteSettings struct {
+	// RequireAdmin2FA forces admin accounts to set up two factor authentication
+	RequireAdmin2FA bool `json:"require_admin_2fa"`
+	// SignupMode is who can sign up, SignupOpen, SignupInvite or SignupClosed
+	SignupMode string `json:"signup_mode"`
+}
+
+// The current site settings, read by every request while admins change them, so only used through Site and UpdateSite.
+var (
+	siteLock sync.RWMutex
+	site     = SiteSettings{SignupMode: SignupOpen}
+)
+
+func siteSettingsInit() {
+	data, err := ioutil.ReadFile(siteSettingsPath)
+	if err != nil {
+		log.Println("No site settings found, using defaults.")
+		return
+	}
+
+	siteLock.Lock()
+	defer siteLock.Unlock()
+
+	err = json.Unmarshal(data, &site)
+	if err != nil {
+		log.Println("[!!] Failed to read site settings:", err)
+	}
+}
+
+// Site gets a copy of the current site settings
+func Site() SiteSettings {
+	siteLock.RLock()
+	defer siteLock.RUnlock()
+	return site
+}
+
+// UpdateSite changes the site settings and writes them out so they are kept after a restart, returning what they now are.
+func UpdateSite(change func(settings *SiteSettings)) SiteSettings {
+	siteLock.Lock()
+	defer siteLock.Unlock()
+
+	change(&site)
+	// Written while still locked so an older change can't be written over a newer one
+	saveSiteSettings(site)
+	return site
+}
+
+// Writes the site settings out
+func saveSiteSettings(settings SiteSettings) {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		log.Println("[!!] Failed to encode site settings:", err)
+		return
+	}
+
+	err = ioutil.WriteFile(siteSettingsPath, data, 0600)
+	if err != nil {
+		log.Println("[!!] Failed to save site settings:", err)
+	}
+}
+
+// Needs2FASetup is if a user must set up two factor authentication before doing anything else
+func Needs2FASetup(user *User) bool {
+	return user.IsAdmin && Site().RequireAdmin2FA && !user.TOTPEnabled
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenPurposeVerify is the purpose of email verification tokens
+	TokenPurposeVerify = "verify"
+	// TokenPurposeEmailChange is the purpose of tokens confirming a new email address
+	TokenPurposeEmailChange = "email-change"
+	// TokenPurposeEmailCancel is the purpose of tokens cancelling an email change from the old address
+	TokenPurposeEmailCancel = "email-cancel"
+)
+
+// tokenKey is the key used to sign tokens sent out to users
+var tokenKey []byte
+
+func tokensInit() {
+	key, err := ioutil.ReadFile("token_key.txt")
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	tokenKey = key
+}
+
+// SignedToken is the data carried inside a signed token
+type SignedToken struct {
+	Purpose string
+	Subject string
+	Nonce   string
+	Expires time.Time
+}
+
+// Signs the payload of a token
+func tokenSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// CreateSignedToken creates a token for a subject which cannot be forged and is only valid for the given time.
+func CreateSignedToken(purpose string, subject string, nonce string, valid time.Duration) string {
+	payload := strings.Join([]string{purpose, subject, nonce, strconv.FormatInt(time.Now().Add(valid).Unix(), 10)}, "|")
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(payload))
+}
+
+// ReadSignedToken checks a token's signature, purpose and expiry and returns what is inside of it.
+func ReadSignedToken(purpose string, token string) (*SignedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(signature, tokenSignature(string(payload))) {
+		return nil, errors.New("bad signature")
+	}
+
+	// purpose|subject|nonce|expires, the subject may itself contain a |
+	fields := strings.Split(string(payload), "|")
+	if len(fields) < 4 || fields[0] != purpose {
+		return nil, errors.New("wrong token purpose")
+	}
+	last := len(fields) - 1
+
+	expires, err := strconv.ParseInt(fields[last], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > expires {
+		return nil, errors.New("token expired")
+	}
+
+	return &SignedToken{
+		Purpose: fields[0],
+		Subject: strings.Join(fields[1:last-1], "|"),
+		Nonce:   fields[last-1],
+		Expires: time.Unix(expires, 0),
+	}, nil
+}
+
+// Gets the user a token was made for. Tokens sent before users had IDs were made for their email,
+// these are still taken until they run out as the nonce has to match either way.
+func tokenUser(ctx context.Context, token *SignedToken) (*User, error) {
+	user, err := GetUserByID(ctx, token.Subject)
+	if errors.Is(err, ErrNotFound) && strings.Contains(token.Subject, "@") {
+		return GetUserByEmail(ctx, token.Subject)
+	}
+	return user, err
+}
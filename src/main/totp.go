@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Length of a time step as per RFC 6238
+	totpPeriod = 30
+	// Number of digits in a code
+	totpDigits = 6
+	// How many steps either side of now a code is still accepted, to allow for clock drift.
+	totpSkew = 1
+	// How many recovery codes a user gets
+	recoveryCodeCount = 10
+	// How many random bytes go into a recovery code, 80 bits so they can't be guessed from their hashes
+	recoveryCodeBytes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generates a new random TOTP secret, encoded in base32 as authenticator apps expect.
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return ""
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// Works out the code for a secret at a given time step (RFC 4226 HOTP)
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// ValidateTOTP checks a code against a secret. It returns the time step the code matched so it can't be used again,
+// codes for steps at or before lastStep are refused.
+func ValidateTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// TOTPURI is the otpauth URI an authenticator app reads from the QR code
+func TOTPURI(user *User, secret string) string {
+	label := url.PathEscape("Smark:" + user.Username)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=Smark&digits=%d&period=%d", label, secret, totpDigits, totpPeriod)
+}
+
+// Puts a recovery code the way it was generated, however it was typed in
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.Replace(strings.Replace(code, "-", "", -1), " ", "", -1))
+}
+
+// Hashes a recovery code the way codes from before they were hashed like passwords were
+func legacyRecoveryHash(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generates a set of recovery codes, returning them to show the user once and their hashes to store.
+// They are hashed like passwords, so nil is returned if that fails rather than them being stored as they are.
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, nil
+		}
+		raw := totpEncoding.EncodeToString(b)
+
+		hash := hashSaltPassword([]byte(raw))
+		if string(hash) == raw {
+			return nil, nil
+		}
+
+		codes[i] = raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:]
+		hashes[i] = string(hash)
+	}
+
+	return codes, hashes
+}
+
+// UseRecoveryCode checks a recovery code and if it is valid removes it so it can't be used again.
+func UseRecoveryCode(user *User, code string) bool {
+	code = normalizeRecoveryCode(code)
+	// Hashing is slow on purpose, so only anything that could be a code is checked
+	if len(code) != totpEncoding.EncodedLen(recoveryCodeBytes) && len(code) != totpEncoding.EncodedLen(5) {
+		return false
+	}
+
+	for i, stored := range user.RecoveryCodes {
+		var matched bool
+		if len(stored) == hex.EncodedLen(sha256.Size) {
+			// Codes made before they were hashed like passwords keep working until they are used or new ones are made
+			matched = subtle.ConstantTimeCompare([]byte(stored), []byte(legacyRecoveryHash(code))) == 1
+		} else if len(code) == totpEncoding.EncodedLen(recoveryCodeBytes) {
+			matched = passMatch([]byte(stored), []byte(code))
+		}
+
+		if matched {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	Cfg.Hashing.BcryptCost = 4
+	defer func() { Cfg.Hashing = defaultConfig().Hashing }()
+
+	codes, hashes := generateRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes", len(codes), len(hashes))
+	}
+	if len(normalizeRecoveryCode(codes[0])) != 16 {
+		t.Errorf("code %s is too short", codes[0])
+	}
+
+	user := &User{RecoveryCodes: hashes}
+	if !UseRecoveryCode(user, " "+codes[3]+" ") {
+		t.Fatal("code wasn't accepted")
+	}
+	if UseRecoveryCode(user, codes[3]) {
+		t.Error("code was accepted twice")
+	}
+	if len(user.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("%d codes left", len(user.RecoveryCodes))
+	}
+}
+
+func TestLegacyRecoveryCodes(t *testing.T) {
+	user := &User{RecoveryCodes: []string{legacyRecoveryHash("ABCD2345")}}
+	if !UseRecoveryCode(user, "abcd-2345") || len(user.RecoveryCodes) != 0 {
+		t.Error("code from before wasn't accepted")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// How long someone has to enter their code after entering their password
+	twoFactorLoginExpiry = 5 * time.Minute
+	// How many codes can be tried before they have to enter their password again
+	twoFactorMaxTries = 5
+)
+
+// Paths an admin who has to set up 2FA can still use, ones ending in / cover everything under them.
+var twoFactorSetupPaths = []string{"/settings/2fa", "/login", "/login/2fa", "/logout", "/impersonate/stop", "/presence/heartbeat", "/404", "/res/"}
+
+// RequireTwoFactorSetup sends admins who have to use 2FA but haven't set it up to do so, whatever they asked for.
+func RequireTwoFactorSetup(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, path := range twoFactorSetupPaths {
+			if req.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(req.URL.Path, path)) {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+
+		user, _, err := GetSessionedUser(req, w)
+		if err == "" && Needs2FASetup(user) {
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "twofactor.required")))
+			http.Redirect(w, req, "/settings/2fa", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Sends a user who got their password right on to enter their code, they are only logged in once that passes.
+func beginTwoFactorLogin(u *User, remember bool, req *http.Request, w http.ResponseWriter) {
+	session, _ := cookies.Get(req, "login-2fa")
+	session.Values["user"] = u.ID
+	session.Values["remember"] = remember
+	session.Values["expires"] = time.Now().Add(twoFactorLoginExpiry).Unix()
+	// Codes tried are counted against this on our side, so sending an older cookie back doesn't give more tries
+	session.Values["login"] = generateSessionKey()
+
+	err := session.Save(req, w)
+	if err != nil {
+		log.Println("[!!] Failed to save 2fa login session:", err)
+	}
+
+	http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
+}
+
+// Key the codes tried during a half finished login are counted against
+func twoFactorAttemptKey(loginID string) string {
+	return "2fa:" + loginID
+}
+
+// Ends a half finished login
+func endTwoFactorLogin(req *http.Request, w http.ResponseWriter) {
+	session, _ := cookies.Get(req, "login-2fa")
+	session.Options.MaxAge = -1
+	session.Save(req, w)
+}
+
+func loginTwoFactorHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+
+	session, _ := cookies.Get(req, "login-2fa")
+	userID, _ := session.Values["user"].(string)
+	expires, _ := session.Values["expires"].(int64)
+	loginID, _ := session.Values["login"].(string)
+	remember, _ := session.Values["remember"].(bool)
+
+	if userID == "" || loginID == "" || time.Now().Unix() > expires {
+		endTwoFactorLogin(req, w)
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "twofactor.login-expired")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if req.Method == "POST" {
+		ctx, cancel := dbContext(req)
+		defer cancel()
+
+		u, err := GetUserByID(ctx, userID)
+		if errors.Is(err, ErrNotFound) {
+			endTwoFactorLogin(req, w)
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			serveDataError(w, req, locale, err)
+			return
+		}
+
+		attempt, throttleErr, attemptsErr := BeginLoginAttempt(ctx, req, locale, u.ID, u.Username)
+		if attemptsErr != nil {
+			serveDataError(w, req, locale, attemptsErr)
+			return
+		}
+		if throttleErr != "" {
+			CreateFlashCookie(req, w, FlashTypeErr, throttleErr)
+			http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		tries, err := Attempts.Reserve(ctx, twoFactorAttemptKey(loginID))
+		if err != nil {
+			attempt.Release(ctx)
+			serveDataError(w, req, locale, err)
+			return
+		}
+		if tries.Failures >= twoFactorMaxTries {
+			attempt.Release(ctx)
+			endTwoFactorLogin(req, w)
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "twofactor.too-many-tries")))
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+			return
+		}
+
+		code := strings.Replace(req.FormValue("code"), " ", "", -1)
+
+		step, ok := ValidateTOTP(u.TOTPSecret, code, u.TOTPLastStep)
+		if ok {
+			u.TOTPLastStep = step
+		} else if UseRecoveryCode(u, code) {
+			ok = true
+			log.Printf("%s logged in with a recovery code, %d left", u.Username, len(u.RecoveryCodes))
+		}
+
+		if !ok {
+			attempt.Fail("wrong 2fa code")
+			if tries.Failures+1 >= twoFactorMaxTries {
+				endTwoFactorLogin(req, w)
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "twofactor.too-many-tries")))
+				http.Redirect(w, req, "/login", http.StatusSeeOther)
+				return
+			}
+
+			CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "twofactor.invalid-code")))
+			http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		// The code has to be saved as used before they are let in
+		if !saveAccountOrFail(w, req, u) {
+			attempt.Release(ctx)
+			return
+		}
+
+		endTwoFactorLogin(req, w)
+		if err := Attempts.Reset(ctx, twoFactorAttemptKey(loginID)); err != nil {
+			log.Println("[!!] Failed to reset 2fa tries:", err)
+		}
+		attempt.Succeed(ctx, u)
+		sessionKey, err := createCookie(ctx, u, req, w)
+		if err != nil {
+			serveDataError(w, req, locale, err)
+			return
+		}
+		if remember {
+			rememberUser(ctx, u, sessionKey, req, w)
+		}
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	user, _, _ := GetSessionedUser(req, w)
+	viewData := &ViewData{Viewer: user}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "login2fa.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing 2fa login template:", templateErr)
+	}
+}
+
+func twoFactorSetupHandle(w http.ResponseWriter, req *http.Request) {
+	user, _, err := GetSessionedUser(req, w)
+	if err != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if req.Method == "POST" {
+		if blockImpersonation(w, req, user) {
+			return
+		}
+
+		code := strings.Replace(req.FormValue("code"), " ", "", -1)
+
+		switch req.FormValue("action") {
+		case "enable":
+			if user.TOTPEnabled || user.TOTPPending == "" {
+				break
+			}
+
+			step, ok := ValidateTOTP(user.TOTPPending, code, 0)
+			if !ok {
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "twofactor.invalid-code")))
+				break
+			}
+
+			codes, hashes := generateRecoveryCodes()
+			if codes == nil {
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.cannot-hash")))
+				break
+			}
+			user.TOTPSecret = user.TOTPPending
+			user.TOTPPending = ""
+			user.TOTPEnabled = true
+			user.TOTPLastStep = step
+			user.RecoveryCodes = hashes
+			if !saveAccountOrFail(w, req, user) {
+				return
+			}
+
+			log.Printf("%s enabled two factor authentication", user.Username)
+
+			// Recovery codes are only ever shown now
+			renderTwoFactorPage(w, req, user, map[string]interface{}{"codes": codes})
+			return
+
+		case "disable":
+			if !user.TOTPEnabled {
+				break
+			}
+			if user.IsAdmin && Site().RequireAdmin2FA {
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "twofactor.required")))
+				break
+			}
+
+			_, ok := ValidateTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+			if !ok && !UseRecoveryCode(user, code) {
+				CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "twofactor.invalid-code")))
+				break
+			}
+
+			user.TOTPEnabled = false
+			user.TOTPSecret = ""
+			user.TOTPLastStep = 0
+			user.RecoveryCodes = nil
+			if !saveAccountOrFail(w, req, user) {
+				return
+			}
+
+			log.Printf("%s disabled two factor authentication", user.Username)
+			CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "twofactor.disabled")))
+		}
+
+		http.Redirect(w, req, "/settings/2fa", http.StatusSeeOther)
+		return
+	}
+
+	data := map[string]interface{}{}
+
+	if !user.TOTPEnabled {
+		// Keep the same secret until they finish so reloading doesn't break an app they already scanned it with
+		if user.TOTPPending == "" {
+			user.TOTPPending = generateTOTPSecret()
+			if !saveAccountOrFail(w, req, user) {
+				return
+			}
+		}
+
+		png, qrErr := qrcode.Encode(TOTPURI(user, user.TOTPPending), qrcode.Medium, 256)
+		if qrErr != nil {
+			log.Println("[!!] Failed to create 2fa QR code:", qrErr)
+		} else {
+			data["qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		}
+		data["secret"] = user.TOTPPending
+	}
+
+	renderTwoFactorPage(w, req, user, data)
+}
+
+// Renders the two factor settings page
+func renderTwoFactorPage(w http.ResponseWriter, req *http.Request, user *User, data map[string]interface{}) {
+	viewData := &ViewData{Viewer: user, Data: data}
+	LoadFlashCookies(req, w, viewData)
+
+	templateErr := templates.ExecuteTemplate(w, "twofactor.html", viewData)
+	if templateErr != nil {
+		log.Println("Error executing 2fa template:", templateErr)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Generates the ID a user keeps for as long as their account exists, in the form of a random UUID.
+func newUserID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Failed to generate user ID: ", err)
+	}
+
+	// Version 4, variant 1
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	id := hex.EncodeToString(b)
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+}
+
+// Gives IDs to any users from before they had them
+func migrateUserIDs(ctx context.Context, dryRun bool) (int, error) {
+	var missing []struct {
+		ID interface{} `bson:"_id"`
+	}
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(bson.M{"uid": bson.M{"$exists": false}}).Select(bson.M{"_id": 1}).All(&missing)
+	})
+	if err != nil || dryRun {
+		return len(missing), err
+	}
+
+	migrated := 0
+	for _, doc := range missing {
+		err := mongoCall(ctx, func() error {
+			return userCollection().UpdateId(doc.ID, bson.M{"$set": bson.M{"uid": newUserID()}})
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("giving user %v an ID: %w", doc.ID, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
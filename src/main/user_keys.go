@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeKey folds a username or email so any that only differ by case, or by how the same characters are written, match.
+func NormalizeKey(in string) string {
+	return norm.NFKC.String(cases.Fold().String(in))
+}
+
+// Fills in the keys a user is looked up by from their names
+func (user *User) setKeys() {
+	user.UsernameKey = NormalizeKey(user.Username)
+	user.EmailKey = NormalizeKey(user.Email)
+	for i := range user.NameHistory {
+		user.NameHistory[i].Key = NormalizeKey(user.NameHistory[i].Name)
+	}
+}
+
+// The fields of a user the keys are made from
+type keyedUser struct {
+	ID          bson.ObjectId `bson:"_id"`
+	Username    string        `bson:"username"`
+	Email       string        `bson:"email"`
+	NameHistory []NameChange  `bson:"namehistory"`
+}
+
+// Gives keys to any users from before they were used.
+// Users that would share a key are logged either way, as they stop the keys being made unique.
+func migrateUserKeys(ctx context.Context, dryRun bool) (int, error) {
+	if err := reportKeyConflicts(ctx); err != nil {
+		return 0, err
+	}
+
+	var missing []keyedUser
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(bson.M{"username_key": bson.M{"$exists": false}}).
+			Select(bson.M{"username": 1, "email": 1, "namehistory": 1}).All(&missing)
+	})
+	if err != nil || dryRun {
+		return len(missing), err
+	}
+
+	migrated := 0
+	for _, keyed := range missing {
+		user := &User{Username: keyed.Username, Email: keyed.Email, NameHistory: keyed.NameHistory}
+		user.setKeys()
+
+		err := mongoCall(ctx, func() error {
+			return userCollection().UpdateId(keyed.ID, bson.M{"$set": bson.M{
+				"username_key": user.UsernameKey,
+				"email_key":    user.EmailKey,
+				"namehistory":  user.NameHistory,
+			}})
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("adding keys to user %s: %w", keyed.Username, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// Logs any users that share a key, which have to be sorted out by hand before the key can be made unique.
+func reportKeyConflicts(ctx context.Context) error {
+	var users []keyedUser
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(nil).Select(bson.M{"username": 1, "email": 1}).All(&users)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range keyConflicts(users) {
+		log.Printf("[!!] Users share the %s %q and need to be changed by hand: %v", conflict.Key, conflict.Value, conflict.Names)
+	}
+	return nil
+}
+
+// KeyConflict is a key more than one user would have
+type KeyConflict struct {
+	Key   string
+	Value string
+	Names []string
+}
+
+// Finds the keys that more than one of the users would have, in the order they are first had.
+func keyConflicts(users []keyedUser) []KeyConflict {
+	var conflicts []KeyConflict
+	for _, key := range []string{"username_key", "email_key"} {
+		var order []string
+		named := map[string][]string{}
+		for _, user := range users {
+			value, name := NormalizeKey(user.Username), user.Username
+			if key == "email_key" {
+				value, name = NormalizeKey(user.Email), user.Email
+			}
+
+			if _, ok := named[value]; !ok {
+				order = append(order, value)
+			}
+			named[value] = append(named[value], name)
+		}
+
+		for _, value := range order {
+			if len(named[value]) > 1 {
+				conflicts = append(conflicts, KeyConflict{Key: key, Value: value, Names: named[value]})
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// Makes sure users are unique by their ID and keys, and that looking them up is quick. Any users sharing a key have to be sorted out first.
+func ensureUserIndexes(ctx context.Context, dryRun bool) (int, error) {
+	indexes := []mgo.Index{
+		{Key: []string{"uid"}, Unique: true},
+		{Key: []string{"username_key"}, Unique: true},
+		{Key: []string{"email_key"}, Unique: true},
+		{Key: []string{"namehistory.key"}},
+	}
+
+	var existing []mgo.Index
+	err := mongoCall(ctx, func() error {
+		var err error
+		existing, err = userCollection().Indexes()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	made := map[string]bool{}
+	for _, index := range existing {
+		made[strings.Join(index.Key, ",")] = true
+	}
+
+	created := 0
+	for _, index := range indexes {
+		if made[strings.Join(index.Key, ",")] {
+			continue
+		}
+
+		if !dryRun {
+			err := mongoCall(ctx, func() error {
+				return userCollection().EnsureIndex(index)
+			})
+			if err != nil {
+				return created, fmt.Errorf("creating %s index: %w", index.Key[0], err)
+			}
+		}
+		created++
+	}
+
+	return created, nil
+}
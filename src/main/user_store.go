@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// UserStore is where accounts are kept. Usernames and emails are matched by their keys, see NormalizeKey.
+// Anything not found gives ErrNotFound, clashing keys ErrDuplicate and any failure to reach the store ErrUnavailable.
+// Users are saved whole with Update, which only goes through if nobody else has saved them since, the Set methods change one thing on its own.
+type UserStore interface {
+	GetByID(ctx context.Context, id string) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetByName(ctx context.Context, username string) (*User, error)
+	// GetByPreviousName gets a user who changed away from the username within the given time
+	GetByPreviousName(ctx context.Context, username string, within time.Duration) (*User, error)
+	GetByEmailOrName(ctx context.Context, field string) (*User, error)
+
+	// Insert stores a new user, who must already have been given an ID.
+	Insert(ctx context.Context, user *User) error
+	// Update replaces the user stored under their ID and moves their version on, giving ErrConflict if it already had been.
+	// When they were last seen, if they are online and who invited them are kept from what is stored, as are their locale and tag if the user given has none.
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, user *User) error
+
+	// DueDeletion gets every user whose deletion grace period has run out by the time given
+	DueDeletion(ctx context.Context, now time.Time) ([]*User, error)
+	// SetLastSeen writes when each user, by ID, was last seen and marks them online, never moving it backwards
+	SetLastSeen(ctx context.Context, lastSeen map[string]time.Time) error
+	// SetOffline marks a user as offline, moving when they were last seen on to the time given if it is later.
+	SetOffline(ctx context.Context, id string, lastSeen time.Time) error
+	SetLocale(ctx context.Context, id string, locale string) error
+	SetGlobalTag(ctx context.Context, id string, tag string) error
+	// ClearInviter forgets who invited anyone invited by the user with the ID given
+	ClearInviter(ctx context.Context, inviterID string) error
+}
+
+// Users is the store accounts are kept in
+var Users UserStore
+
+func userStoreInit() {
+	switch Cfg.Storage.Users {
+	case "memory":
+		log.Println("[!!] Keeping users in memory, they will be lost on a restart.")
+		Users = newMemoryUserStore()
+	case "sqlite", "postgres":
+		Users = newSQLUserStore(Cfg.Storage.Users, Cfg.Storage.DSN)
+	default:
+		Users = newMongoUserStore()
+	}
+}
+
+// Copies a user so a stored user can't be changed without being saved
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Password = append([]byte(nil), user.Password...)
+	copied.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	copied.NameHistory = append([]NameChange(nil), user.NameHistory...)
+	return &copied
+}
+
+// Copies what is set on its own, rather than saved whole, from the stored user to the one being saved.
+func keepSetFields(saved *User, stored *User) {
+	saved.Online = stored.Online
+	if stored.LastSeen.After(saved.LastSeen) {
+		saved.LastSeen = stored.LastSeen
+	}
+	if saved.Locale == "" {
+		saved.Locale = stored.Locale
+	}
+	if saved.GlobalTag == "" {
+		saved.GlobalTag = stored.GlobalTag
+	}
+	// Only ever given when they sign up, and taken away when their inviter is deleted
+	saved.InvitedBy = stored.InvitedBy
+}
+
+// memoryUserStore keeps users in memory, for running without a database.
+type memoryUserStore struct {
+	lock sync.RWMutex
+	// users is indexed by their ID
+	users map[string]*User
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: map[string]*User{}}
+}
+
+// Finds the first user matching, the lock must be held
+func (s *memoryUserStore) find(match func(user *User) bool) (*User, error) {
+	for _, user := range s.users {
+		if match(user) {
+			return copyUser(user), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Checks if a user's keys are used by anyone else, the lock must be held.
+func (s *memoryUserStore) clashes(user *User) bool {
+	for id, existing := range s.users {
+		if id != user.ID && (existing.EmailKey == user.EmailKey || existing.UsernameKey == user.UsernameKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryUserStore) GetByID(ctx context.Context, id string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (s *memoryUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key := NormalizeKey(email)
+	return s.find(func(user *User) bool {
+		return user.EmailKey == key
+	})
+}
+
+func (s *memoryUserStore) GetByName(ctx context.Context, username string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key := NormalizeKey(username)
+	return s.find(func(user *User) bool {
+		return user.UsernameKey == key
+	})
+}
+
+func (s *memoryUserStore) GetByPreviousName(ctx context.Context, username string, within time.Duration) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key := NormalizeKey(username)
+	since := time.Now().Add(-within)
+	return s.find(func(user *User) bool {
+		for _, change := range user.NameHistory {
+			if change.Key == key && change.ChangedAt.After(since) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *memoryUserStore) GetByEmailOrName(ctx context.Context, field string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key := NormalizeKey(field)
+	return s.find(func(user *User) bool {
+		return user.UsernameKey == key || user.EmailKey == key
+	})
+}
+
+func (s *memoryUserStore) Insert(ctx context.Context, user *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user.setKeys()
+	if _, ok := s.users[user.ID]; ok || s.clashes(user) {
+		return ErrDuplicate
+	}
+
+	s.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (s *memoryUserStore) Update(ctx context.Context, user *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrConflict
+	}
+
+	user.setKeys()
+	if s.clashes(user) {
+		return ErrDuplicate
+	}
+
+	saved := copyUser(user)
+	keepSetFields(saved, stored)
+	saved.Version++
+
+	s.users[user.ID] = saved
+	user.Version = saved.Version
+	return nil
+}
+
+func (s *memoryUserStore) Delete(ctx context.Context, user *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[user.ID]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.users, user.ID)
+	return nil
+}
+
+func (s *memoryUserStore) DueDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var due []*User
+	for _, user := range s.users {
+		if !user.DeleteAfter.IsZero() && !user.DeleteAfter.After(now) {
+			due = append(due, copyUser(user))
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryUserStore) SetLastSeen(ctx context.Context, lastSeen map[string]time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, seen := range lastSeen {
+		if user, ok := s.users[id]; ok && seen.After(user.LastSeen) {
+			user.LastSeen = seen
+			user.Online = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryUserStore) SetOffline(ctx context.Context, id string, lastSeen time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	user.Online = false
+	if lastSeen.After(user.LastSeen) {
+		user.LastSeen = lastSeen
+	}
+	return nil
+}
+
+func (s *memoryUserStore) SetLocale(ctx context.Context, id string, locale string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	user.Locale = locale
+	return nil
+}
+
+func (s *memoryUserStore) SetGlobalTag(ctx context.Context, id string, tag string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	user.GlobalTag = tag
+	return nil
+}
+
+func (s *memoryUserStore) ClearInviter(ctx context.Context, inviterID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, user := range s.users {
+		if user.InvitedBy == inviterID {
+			user.InvitedBy = ""
+		}
+	}
+	return nil
+}
+
+// mongoUserStore keeps users in the users collection
+type mongoUserStore struct{}
+
+func newMongoUserStore() *mongoUserStore {
+	return &mongoUserStore{}
+}
+
+// Turns an error from mgo into one of the data errors
+func mongoError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == mgo.ErrNotFound:
+		return ErrNotFound
+	case mgo.IsDup(err):
+		return ErrDuplicate
+	default:
+		return unavailable(err)
+	}
+}
+
+// Runs a call to Mongo, giving up on it once the context is done as mgo can't be given one itself.
+func mongoCall(ctx context.Context, call func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return mongoError(err)
+	case <-ctx.Done():
+		return unavailable(ctx.Err())
+	}
+}
+
+func (s *mongoUserStore) findOne(ctx context.Context, query bson.M) (*User, error) {
+	var rUser *User
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(query).One(&rUser)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rUser, nil
+}
+
+func (s *mongoUserStore) GetByID(ctx context.Context, id string) (*User, error) {
+	return s.findOne(ctx, bson.M{"uid": id})
+}
+
+func (s *mongoUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findOne(ctx, bson.M{"email_key": NormalizeKey(email)})
+}
+
+func (s *mongoUserStore) GetByName(ctx context.Context, username string) (*User, error) {
+	return s.findOne(ctx, bson.M{"username_key": NormalizeKey(username)})
+}
+
+func (s *mongoUserStore) GetByPreviousName(ctx context.Context, username string, within time.Duration) (*User, error) {
+	return s.findOne(ctx, bson.M{"namehistory": bson.M{"$elemMatch": bson.M{
+		"key":       NormalizeKey(username),
+		"changedat": bson.M{"$gt": time.Now().Add(-within)},
+	}}})
+}
+
+func (s *mongoUserStore) GetByEmailOrName(ctx context.Context, field string) (*User, error) {
+	key := NormalizeKey(field)
+	return s.findOne(ctx, bson.M{"$or": []bson.M{{"username_key": key}, {"email_key": key}}})
+}
+
+func (s *mongoUserStore) Insert(ctx context.Context, user *User) error {
+	user.setKeys()
+	return mongoCall(ctx, func() error {
+		return userCollection().Insert(user)
+	})
+}
+
+// Gets the fields of a user to set when saving them whole, leaving out the ones set on their own.
+func savedFields(user *User) (bson.M, error) {
+	raw, err := bson.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields bson.M
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	delete(fields, "online")
+	delete(fields, "lastseen")
+	delete(fields, "invitedby")
+	if user.Locale == "" {
+		delete(fields, "locale")
+	}
+	if user.GlobalTag == "" {
+		delete(fields, "globaltag")
+	}
+	return fields, nil
+}
+
+func (s *mongoUserStore) Update(ctx context.Context, user *User) error {
+	user.setKeys()
+	fields, err := savedFields(user)
+	if err != nil {
+		return unavailable(err)
+	}
+	fields["version"] = user.Version + 1
+
+	err = mongoCall(ctx, func() error {
+		return userCollection().Update(
+			bson.M{"uid": user.ID, "version": user.Version},
+			bson.M{"$set": fields, "$max": bson.M{"lastseen": user.LastSeen}},
+		)
+	})
+
+	// Either they are gone or someone else saved them first
+	if errors.Is(err, ErrNotFound) {
+		if _, lookupErr := s.GetByID(ctx, user.ID); lookupErr == nil {
+			return ErrConflict
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	user.Version++
+	return nil
+}
+
+func (s *mongoUserStore) Delete(ctx context.Context, user *User) error {
+	return mongoCall(ctx, func() error {
+		return userCollection().Remove(bson.M{"uid": user.ID})
+	})
+}
+
+func (s *mongoUserStore) DueDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	var users []*User
+	err := mongoCall(ctx, func() error {
+		return userCollection().Find(bson.M{"deleteafter": bson.M{"$gt": time.Time{}, "$lte": now}}).All(&users)
+	})
+	return users, err
+}
+
+func (s *mongoUserStore) SetLastSeen(ctx context.Context, lastSeen map[string]time.Time) error {
+	return mongoCall(ctx, func() error {
+		bulk := userCollection().Bulk()
+		bulk.Unordered()
+		for id, seen := range lastSeen {
+			bulk.Update(
+				bson.M{"uid": id, "lastseen": bson.M{"$lt": seen}},
+				bson.M{"$set": bson.M{"lastseen": seen, "online": true}},
+			)
+		}
+
+		_, err := bulk.Run()
+		return err
+	})
+}
+
+func (s *mongoUserStore) SetOffline(ctx context.Context, id string, lastSeen time.Time) error {
+	return mongoCall(ctx, func() error {
+		return userCollection().Update(bson.M{"uid": id}, bson.M{
+			"$set": bson.M{"online": false},
+			"$max": bson.M{"lastseen": lastSeen},
+		})
+	})
+}
+
+func (s *mongoUserStore) SetLocale(ctx context.Context, id string, locale string) error {
+	return mongoCall(ctx, func() error {
+		return userCollection().Update(bson.M{"uid": id}, bson.M{"$set": bson.M{"locale": locale}})
+	})
+}
+
+func (s *mongoUserStore) SetGlobalTag(ctx context.Context, id string, tag string) error {
+	return mongoCall(ctx, func() error {
+		return userCollection().Update(bson.M{"uid": id}, bson.M{"$set": bson.M{"globaltag": tag}})
+	})
+}
+
+func (s *mongoUserStore) ClearInviter(ctx context.Context, inviterID string) error {
+	return mongoCall(ctx, func() error {
+		_, err := userCollection().UpdateAll(bson.M{"invitedby": inviterID}, bson.M{"$set": bson.M{"invitedby": ""}})
+		return err
+	})
+}
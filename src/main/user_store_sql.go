@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	// SQL drivers picked between by the storage config, also used to tell what went wrong
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlUserStore keeps users in SQLite or Postgres. Users are stored as JSON with the columns they are looked up by alongside,
+// the tables are made and kept up to date by the SQL migrations.
+type sqlUserStore struct {
+	db *sql.DB
+}
+
+func newSQLUserStore(backend string, dsn string) *sqlUserStore {
+	driver := "postgres"
+	if backend == "sqlite" {
+		driver = "sqlite3"
+	}
+
+	db, err := openSQL(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Connected to %s for users", backend)
+	return &sqlUserStore{db: db}
+}
+
+// Opens a SQL database. SQLite only lets one writer in at a time, so it is given one connection to queue on
+// and told to wait for anyone else using the file, rather than failing with it being busy.
+func openSQL(driver string, dsn string) (*sql.DB, error) {
+	if driver != "sqlite3" {
+		return sql.Open(driver, dsn)
+	}
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	db, err := sql.Open(driver, dsn+separator+"_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// Gets the unix time stored for a deletion date, 0 for none
+func deleteAfterColumn(user *User) int64 {
+	if user.DeleteAfter.IsZero() {
+		return 0
+	}
+	return user.DeleteAfter.Unix()
+}
+
+// Turns an error from a SQL driver into one of the data errors
+func sqlError(err error) error {
+	var pqErr *pq.Error
+	var sqliteErr sqlite3.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case err == sql.ErrNoRows:
+		return ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		return ErrDuplicate
+	case errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint:
+		return ErrDuplicate
+	default:
+		return unavailable(err)
+	}
+}
+
+func (s *sqlUserStore) findOne(ctx context.Context, query string, args ...interface{}) (*User, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&data)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	var user *User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, sqlError(err)
+	}
+
+	return user, nil
+}
+
+func (s *sqlUserStore) GetByID(ctx context.Context, id string) (*User, error) {
+	return s.findOne(ctx, `SELECT data FROM users WHERE id = $1`, id)
+}
+
+func (s *sqlUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findOne(ctx, `SELECT data FROM users WHERE email_key = $1`, NormalizeKey(email))
+}
+
+func (s *sqlUserStore) GetByName(ctx context.Context, username string) (*User, error) {
+	return s.findOne(ctx, `SELECT data FROM users WHERE username_key = $1`, NormalizeKey(username))
+}
+
+func (s *sqlUserStore) GetByPreviousName(ctx context.Context, username string, within time.Duration) (*User, error) {
+	return s.findOne(ctx, `SELECT users.data FROM users JOIN user_names ON user_names.user_id = users.id
+		WHERE user_names.name_key = $1 AND user_names.changed_at > $2 LIMIT 1`,
+		NormalizeKey(username), time.Now().Add(-within).Unix())
+}
+
+func (s *sqlUserStore) GetByEmailOrName(ctx context.Context, field string) (*User, error) {
+	return s.findOne(ctx, `SELECT data FROM users WHERE username_key = $1 OR email_key = $1 LIMIT 1`, NormalizeKey(field))
+}
+
+// Rewrites the name history of a user so it can be searched
+func (s *sqlUserStore) writeNames(ctx context.Context, tx *sql.Tx, user *User) error {
+	for _, change := range user.NameHistory {
+		_, err := tx.ExecContext(ctx, `INSERT INTO user_names (user_id, name_key, changed_at) VALUES ($1, $2, $3)`,
+			user.ID, change.Key, change.ChangedAt.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inserts a user as part of a transaction
+func (s *sqlUserStore) insert(ctx context.Context, tx *sql.Tx, user *User) error {
+	user.setKeys()
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO users (id, email_key, username_key, delete_after, version, data) VALUES ($1, $2, $3, $4, $5, $6)`,
+		user.ID, user.EmailKey, user.UsernameKey, deleteAfterColumn(user), user.Version, string(data))
+	if err != nil {
+		return err
+	}
+
+	return s.writeNames(ctx, tx, user)
+}
+
+func (s *sqlUserStore) Insert(ctx context.Context, user *User) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	if err := s.insert(ctx, tx, user); err != nil {
+		return sqlError(err)
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// Reads a user and the version they are at as part of a transaction
+func (s *sqlUserStore) read(ctx context.Context, tx *sql.Tx, id string) (*User, int, error) {
+	var data string
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT data, version FROM users WHERE id = $1`, id).Scan(&data, &version)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var user *User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, 0, err
+	}
+
+	return user, version, nil
+}
+
+func (s *sqlUserStore) Update(ctx context.Context, user *User) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	stored, version, err := s.read(ctx, tx, user.ID)
+	if err != nil {
+		return sqlError(err)
+	}
+	if version != user.Version {
+		return ErrConflict
+	}
+
+	user.setKeys()
+	saved := copyUser(user)
+	keepSetFields(saved, stored)
+	saved.Version++
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET email_key = $1, username_key = $2, delete_after = $3, data = $4, version = $5
+		WHERE id = $6 AND version = $7`,
+		user.EmailKey, user.UsernameKey, deleteAfterColumn(user), string(data), saved.Version, user.ID, user.Version)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	// Saved by someone else between being read and written
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return ErrConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_names WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	if err := s.writeNames(ctx, tx, user); err != nil {
+		return sqlError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return sqlError(err)
+	}
+
+	user.Version = saved.Version
+	return nil
+}
+
+func (s *sqlUserStore) Delete(ctx context.Context, user *User) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, user.ID)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_names WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// Reads every user a query gives
+func scanUsers(rows *sql.Rows, err error) ([]*User, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var user *User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (s *sqlUserStore) DueDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	users, err := scanUsers(s.db.QueryContext(ctx, `SELECT data FROM users WHERE delete_after > 0 AND delete_after <= $1`, now.Unix()))
+	return users, sqlError(err)
+}
+
+// Changes one thing about a user as part of a transaction without moving their version on.
+// It is only written if they haven't been saved since being read, being read again if they have so the save isn't undone.
+func (s *sqlUserStore) modify(ctx context.Context, tx *sql.Tx, id string, change func(user *User) bool) error {
+	for tries := 0; tries < 3; tries++ {
+		user, version, err := s.read(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Nothing to change
+		if !change(user) {
+			return nil
+		}
+
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `UPDATE users SET data = $1 WHERE id = $2 AND version = $3`, string(data), id, version)
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
+
+// Changes one thing about a user in a transaction of its own
+func (s *sqlUserStore) modifyOne(ctx context.Context, id string, change func(user *User) bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	if err := s.modify(ctx, tx, id, change); err != nil {
+		return sqlError(err)
+	}
+
+	return sqlError(tx.Commit())
+}
+
+func (s *sqlUserStore) SetLastSeen(ctx context.Context, lastSeen map[string]time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	for id, seen := range lastSeen {
+		err := s.modify(ctx, tx, id, func(user *User) bool {
+			if !seen.After(user.LastSeen) {
+				return false
+			}
+			user.LastSeen = seen
+			user.Online = true
+			return true
+		})
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return sqlError(err)
+		}
+	}
+
+	return sqlError(tx.Commit())
+}
+
+func (s *sqlUserStore) SetOffline(ctx context.Context, id string, lastSeen time.Time) error {
+	return s.modifyOne(ctx, id, func(user *User) bool {
+		user.Online = false
+		if lastSeen.After(user.LastSeen) {
+			user.LastSeen = lastSeen
+		}
+		return true
+	})
+}
+
+func (s *sqlUserStore) SetLocale(ctx context.Context, id string, locale string) error {
+	return s.modifyOne(ctx, id, func(user *User) bool {
+		user.Locale = locale
+		return true
+	})
+}
+
+func (s *sqlUserStore) SetGlobalTag(ctx context.Context, id string, tag string) error {
+	return s.modifyOne(ctx, id, func(user *User) bool {
+		user.GlobalTag = tag
+		return true
+	})
+}
+
+// Who invited them is only kept in their data, so every user is looked through
+func (s *sqlUserStore) ClearInviter(ctx context.Context, inviterID string) error {
+	users, err := scanUsers(s.db.QueryContext(ctx, `SELECT data FROM users`))
+	if err != nil {
+		return sqlError(err)
+	}
+
+	for _, invited := range users {
+		if invited.InvitedBy != inviterID {
+			continue
+		}
+
+		err := s.modifyOne(ctx, invited.ID, func(user *User) bool {
+			if user.InvitedBy != inviterID {
+				return false
+			}
+			user.InvitedBy = ""
+			return true
+		})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
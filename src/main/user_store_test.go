@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// Each backend the suite is run against. Mongo and Postgres are only tried when given with
+// SMARK_TEST_MONGO and SMARK_TEST_POSTGRES, which should point at a database that can be thrown away.
+var userStoreBackends = []struct {
+	name string
+	open func(t *testing.T) UserStore
+}{
+	{"memory", func(t *testing.T) UserStore { return newMemoryUserStore() }},
+	{"sqlite", openTestSQLiteUsers},
+	{"postgres", openTestPostgresUsers},
+	{"mongo", openTestMongoUsers},
+}
+
+// Brings a SQL database's tables up to date for a test
+func migrateTestSQL(t *testing.T, db *sql.DB) *sqlUserStore {
+	if _, err := migrate(context.Background(), newSQLMigrationLog(db), sqlMigrations(db), false); err != nil {
+		t.Fatal(err)
+	}
+	return &sqlUserStore{db: db}
+}
+
+func openTestSQLiteUsers(t *testing.T) UserStore {
+	return migrateTestSQL(t, openTestSQLite(t))
+}
+
+func openTestPostgresUsers(t *testing.T) UserStore {
+	dsn := os.Getenv("SMARK_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("SMARK_TEST_POSTGRES not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Postgres isn't reachable:", err)
+	}
+
+	dropTables := func() {
+		for _, table := range []string{"user_names", "users", "migrations", "migration_lock"} {
+			db.Exec(`DROP TABLE IF EXISTS ` + table)
+		}
+	}
+	dropTables()
+	t.Cleanup(func() {
+		dropTables()
+		db.Close()
+	})
+
+	return migrateTestSQL(t, db)
+}
+
+func openTestMongoUsers(t *testing.T) UserStore {
+	url := os.Getenv("SMARK_TEST_MONGO")
+	if url == "" {
+		t.Skip("SMARK_TEST_MONGO not set")
+	}
+
+	dialed, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skip("Mongo isn't reachable:", err)
+	}
+
+	previous, previousDatabase := session, mongoDatabase
+	session, mongoDatabase = dialed, fmt.Sprintf("smark_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		session.DB(mongoDatabase).DropDatabase()
+		dialed.Close()
+		session, mongoDatabase = previous, previousDatabase
+	})
+
+	if _, err := migrate(context.Background(), &mongoMigrationLog{}, mongoMigrations, false); err != nil {
+		t.Fatal(err)
+	}
+	return newMongoUserStore()
+}
+
+// Runs a test against every backend that can be reached
+func forEachUserStore(t *testing.T, test func(t *testing.T, store UserStore)) {
+	for _, backend := range userStoreBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+// Inserts a new user for a test
+func insertTestUser(t *testing.T, store UserStore, username string, email string) *User {
+	user := &User{ID: newUserID(), Username: username, Email: email}
+	if err := store.Insert(context.Background(), user); err != nil {
+		t.Fatalf("inserting %s: %v", username, err)
+	}
+	return user
+}
+
+func TestUserStoreGet(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		user := insertTestUser(t, store, "Ellie", "Ellie@Example.com")
+
+		for name, get := range map[string]func() (*User, error){
+			"id":            func() (*User, error) { return store.GetByID(ctx, user.ID) },
+			"email":         func() (*User, error) { return store.GetByEmail(ctx, "ellie@example.COM") },
+			"name":          func() (*User, error) { return store.GetByName(ctx, "ELLIE") },
+			"name or email": func() (*User, error) { return store.GetByEmailOrName(ctx, "ellie") },
+			"email or name": func() (*User, error) { return store.GetByEmailOrName(ctx, "ellie@example.com") },
+		} {
+			found, err := get()
+			if err != nil {
+				t.Errorf("by %s: %v", name, err)
+				continue
+			}
+			if found.ID != user.ID || found.Username != "Ellie" || found.Email != "Ellie@Example.com" {
+				t.Errorf("by %s got %+v", name, found)
+			}
+		}
+	})
+}
+
+func TestUserStoreNotFound(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		for name, get := range map[string]func() (*User, error){
+			"id":            func() (*User, error) { return store.GetByID(ctx, newUserID()) },
+			"email":         func() (*User, error) { return store.GetByEmail(ctx, "sam@example.com") },
+			"name":          func() (*User, error) { return store.GetByName(ctx, "Sam") },
+			"previous name": func() (*User, error) { return store.GetByPreviousName(ctx, "Sam", time.Hour) },
+			"name or email": func() (*User, error) { return store.GetByEmailOrName(ctx, "Sam") },
+		} {
+			if _, err := get(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("by %s gave %v, want not found", name, err)
+			}
+		}
+	})
+}
+
+func TestUserStoreInsertDuplicate(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		for _, user := range []*User{
+			{ID: newUserID(), Username: "ELLIE", Email: "other@example.com"},
+			{ID: newUserID(), Username: "Sam", Email: "Ellie@Example.com"},
+		} {
+			if err := store.Insert(ctx, user); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("inserting %s <%s> gave %v, want duplicate", user.Username, user.Email, err)
+			}
+		}
+	})
+}
+
+func TestUserStoreUpdate(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		user := insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		user.Username = "Eleanor"
+		user.NameHistory = []NameChange{{Name: "Ellie", ChangedAt: time.Now()}}
+		if err := store.Update(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if user.Version != 1 {
+			t.Errorf("version is %d after saving once", user.Version)
+		}
+
+		found, err := store.GetByName(ctx, "eleanor")
+		if err != nil || found.ID != user.ID || found.Version != 1 {
+			t.Fatalf("got %+v, %v", found, err)
+		}
+
+		previous, err := store.GetByPreviousName(ctx, "ellie", time.Hour)
+		if err != nil || previous.ID != user.ID {
+			t.Errorf("by previous name got %+v, %v", previous, err)
+		}
+		if _, err := store.GetByName(ctx, "Ellie"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("old name still found: %v", err)
+		}
+	})
+}
+
+func TestUserStoreUpdateDuplicate(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		insertTestUser(t, store, "Ellie", "ellie@example.com")
+		sam := insertTestUser(t, store, "Sam", "sam@example.com")
+
+		sam.Username = "ellie"
+		if err := store.Update(ctx, sam); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("taking a used name gave %v, want duplicate", err)
+		}
+	})
+}
+
+func TestUserStoreVersionCheck(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		user := insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		first, _ := store.GetByID(ctx, user.ID)
+		second, _ := store.GetByID(ctx, user.ID)
+
+		first.IsAdmin = true
+		if err := store.Update(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+
+		// Read before the first was saved, so it would undo it
+		second.Locale = "DE"
+		if err := store.Update(ctx, second); !errors.Is(err, ErrConflict) {
+			t.Fatalf("saving an old copy gave %v, want conflict", err)
+		}
+
+		found, _ := store.GetByID(ctx, user.ID)
+		if !found.IsAdmin || found.Locale == "DE" {
+			t.Errorf("got %+v after the conflict", found)
+		}
+	})
+}
+
+func TestUserStoreSetFieldsKept(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		user := insertTestUser(t, store, "Ellie", "ellie@example.com")
+		copied, _ := store.GetByID(ctx, user.ID)
+
+		seen := time.Now().Add(-time.Minute).Truncate(time.Second)
+		if err := store.SetLastSeen(ctx, map[string]time.Time{user.ID: seen}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetLocale(ctx, user.ID, "DE"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetGlobalTag(ctx, user.ID, "[OG]"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Set on their own, so saving a copy read before doesn't undo them
+		copied.IsAdmin = true
+		if err := store.Update(ctx, copied); err != nil {
+			t.Fatal(err)
+		}
+
+		found, _ := store.GetByID(ctx, user.ID)
+		if !found.IsAdmin || !found.Online || !found.LastSeen.Equal(seen) || found.Locale != "DE" || found.GlobalTag != "[OG]" {
+			t.Errorf("got %+v", found)
+		}
+
+		if err := store.SetOffline(ctx, user.ID, seen.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		found, _ = store.GetByID(ctx, user.ID)
+		if found.Online || !found.LastSeen.Equal(seen) {
+			t.Errorf("offline got online %v and last seen %v, want it kept at %v", found.Online, found.LastSeen, seen)
+		}
+	})
+}
+
+func TestUserStoreClearInviter(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		inviter := insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		invited := &User{ID: newUserID(), Username: "Sam", Email: "sam@example.com", InvitedBy: inviter.ID}
+		if err := store.Insert(ctx, invited); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.ClearInviter(ctx, inviter.ID); err != nil {
+			t.Fatal(err)
+		}
+		found, _ := store.GetByID(ctx, invited.ID)
+		if found.InvitedBy != "" {
+			t.Errorf("still invited by %q", found.InvitedBy)
+		}
+	})
+}
+
+func TestUserStoreDelete(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		user := insertTestUser(t, store, "Ellie", "ellie@example.com")
+
+		if err := store.Delete(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetByID(ctx, user.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("found after being deleted: %v", err)
+		}
+		if err := store.Delete(ctx, user); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting again gave %v, want not found", err)
+		}
+
+		// Their name and email are free again
+		insertTestUser(t, store, "Ellie", "ellie@example.com")
+	})
+}
+
+func TestUserStoreDueDeletion(t *testing.T) {
+	forEachUserStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		now := time.Now()
+
+		due := insertTestUser(t, store, "Ellie", "ellie@example.com")
+		due.DeleteAfter = now.Add(-time.Hour)
+		later := insertTestUser(t, store, "Sam", "sam@example.com")
+		later.DeleteAfter = now.Add(time.Hour)
+		insertTestUser(t, store, "Alex", "alex@example.com")
+
+		for _, user := range []*User{due, later} {
+			if err := store.Update(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		users, err := store.DueDeletion(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].ID != due.ID {
+			t.Errorf("got %d users due deletion, want only %s", len(users), due.Username)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// UserAgent is the device and browser a session was used from
+type UserAgent struct {
+	Device  string
+	Browser string
+}
+
+// Checked in order, as most browsers claim to be several others too
+var uaDevices = []struct{ token, name string }{
+	{"iPad", "iPad"},
+	{"iPhone", "iPhone"},
+	{"Android", "Android"},
+	{"Windows", "Windows"},
+	{"CrOS", "Chrome OS"},
+	{"Macintosh", "Mac"},
+	{"Linux", "Linux"},
+}
+
+var uaBrowsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"Trident/", "Internet Explorer"},
+}
+
+// ParseUserAgent works out roughly what device and browser a User-Agent header is from.
+// Anything not recognised is left empty.
+func ParseUserAgent(header string) UserAgent {
+	var agent UserAgent
+
+	for _, device := range uaDevices {
+		if strings.Contains(header, device.token) {
+			agent.Device = device.name
+			break
+		}
+	}
+
+	for _, browser := range uaBrowsers {
+		if strings.Contains(header, browser.token) {
+			agent.Browser = browser.name
+			break
+		}
+	}
+
+	return agent
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long a user must wait before asking for another verification email
+const verifyResendCooldown = time.Minute
+
+// SendVerification creates a new verification token for a pending user and emails it to them.
+// Any link sent before this one stops working.
+func SendVerification(ctx context.Context, user *User, locale string) bool {
+	user.VerifyNonce = generateSessionKey()
+	user.VerifySent = time.Now()
+	// The link wouldn't work without the nonce saved
+	if SaveAccount(ctx, user) != nil {
+		return false
+	}
+
+	token := CreateSignedToken(TokenPurposeVerify, user.ID, user.VerifyNonce, time.Duration(Cfg.VerifyExpiryHours)*time.Hour)
+	link := Cfg.BaseURL + "/verify?token=" + url.QueryEscape(token)
+
+	return SendMail(user.Email, string(T(locale, "mail.verify.subject")), string(T(locale, "mail.verify.body", user.Username, link)))
+}
+
+func verifyHandle(w http.ResponseWriter, req *http.Request) {
+	locale := GetLocale(req)
+
+	token, err := ReadSignedToken(TokenPurposeVerify, req.FormValue("token"))
+	if err != nil {
+		log.Printf("Rejected verification token: %s", err)
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "verify.invalid")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	user, err := tokenUser(ctx, token)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		serveDataError(w, req, locale, err)
+		return
+	}
+
+	// The nonce is cleared once used, so the link can only be used once.
+	if user == nil || !user.Pending || user.VerifyNonce == "" || user.VerifyNonce != token.Nonce {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(locale, "verify.invalid")))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user.Pending = false
+	user.VerifyNonce = ""
+	if !saveAccountOrFail(w, req, user) {
+		return
+	}
+
+	log.Printf("Verified user %s", user.Username)
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(locale, "verify.verified")))
+	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+}
+
+func verifyResendHandle(w http.ResponseWriter, req *http.Request) {
+	user, _, err := GetSessionedUser(req, w)
+	if err != "" {
+		CreateFlashCookie(req, w, FlashTypeErr, err)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if req.Method != "POST" || !user.Pending {
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if time.Since(user.VerifySent) < verifyResendCooldown {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "verify.resend-wait")))
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := dbContext(req)
+	defer cancel()
+
+	if !SendVerification(ctx, user, user.Locale) {
+		CreateFlashCookie(req, w, FlashTypeErr, string(T(user.Locale, "error.mail-failed")))
+		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	CreateFlashCookie(req, w, FlashTypeInfo, string(T(user.Locale, "verify.sent", user.Email)))
+	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+}